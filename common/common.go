@@ -2,16 +2,57 @@ package common
 
 import (
 	"bufio"
+	"errors"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 
 	"github.com/blevesearch/snowballstem"
+	"github.com/blevesearch/snowballstem/english"
 )
 
 var StopWords = make(map[string]int)
 var SnowballEnv = snowballstem.NewEnv("")
 
+// GenerationsDir is the directory of the out directory the indexer writes
+// each generation into. GenerationMarker names the newest finished
+// generation and ServedGenerationMarker the one the search server loaded
+// last, which the indexer never removes.
+const GenerationsDir = "generations"
+const GenerationMarker = "generation"
+const ServedGenerationMarker = "served"
+
+// ReadMarker returns the generation named by a marker file of outDir, empty
+// when there is no marker
+func ReadMarker(outDir string, marker string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(outDir, marker))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// WriteMarker points a marker file of outDir at name, through a temporary
+// file so readers never see a partial name
+func WriteMarker(outDir string, marker string, name string) error {
+	markerPath := filepath.Join(outDir, marker)
+	tmpPath := markerPath + ".tmp"
+
+	err := os.WriteFile(tmpPath, []byte(name+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, markerPath)
+}
+
+var splitDelimiters = regexp.MustCompile(`[^A-Za-z]+`)
+
 func LoadStopWords(path string) error {
 	file, err := os.Open(path)
 	if err != nil {
@@ -33,7 +74,6 @@ func LoadStopWords(path string) error {
 }
 
 func FormatWord(word *string) {
-	splitDelimiters := regexp.MustCompile(`[^A-Za-z]+`)
 	parts := splitDelimiters.Split(*word, -1)
 	if len(parts) == 0 {
 		*word = ""
@@ -50,6 +90,53 @@ func FormatWord(word *string) {
 	*word = strings.ToLower(*word)
 }
 
+// StemWord stems with its own environment, unlike SnowballEnv it is safe to
+// call from concurrent requests
+func StemWord(word string) string {
+	env := snowballstem.NewEnv(word)
+	english.Stem(env)
+	return env.Current()
+}
+
+// AnalyzeWord turns a raw word into the term it is indexed under, ok is
+// false when nothing is left or the word is a stop word
+func AnalyzeWord(word string) (string, bool) {
+	// trim both ends of word of non number or letter characters
+	FormatWord(&word)
+	if word == "" {
+		return "", false
+	}
+
+	// skip this word if it's a stop word
+	_, isStopWord := StopWords[word]
+	if isStopWord {
+		return "", false
+	}
+
+	return StemWord(word), true
+}
+
+// NormalizeHost lowercases host and drops its port and a leading www. so
+// hosts written either way compare equal
+func NormalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+
+	return strings.TrimPrefix(host, "www.")
+}
+
+// HostOf returns the normalized host of a url, empty when it has none
+func HostOf(rawUrl string) string {
+	parsed, err := url.Parse(strings.TrimSpace(rawUrl))
+	if err != nil {
+		return ""
+	}
+
+	return NormalizeHost(parsed.Host)
+}
+
 func Foo[T any](val T) {
 
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// value stored when an attribute cannot be determined
+const unknownAttribute = "unknown"
+
+// the most common words of each language, a document's language is the
+// one whose words it uses most
+var languageWords = map[string][]string{
+	"en": {"the", "and", "of", "to", "in", "is", "that", "for", "it", "with", "as", "was", "on", "are", "by", "this", "be", "from"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "dans", "que", "pour", "qui", "du", "sur", "par", "pas", "au", "avec", "sont"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "mit", "den", "von", "ein", "eine", "zu", "auf", "sich", "dem", "auch", "wird", "im"},
+	"es": {"el", "los", "las", "y", "es", "una", "por", "con", "para", "del", "se", "que", "como", "pero", "su", "al", "lo", "fue"},
+	"it": {"il", "di", "che", "e", "la", "per", "una", "sono", "della", "con", "non", "gli", "del", "nel", "anche", "come", "alla", "questo"},
+	"pt": {"o", "os", "que", "e", "do", "da", "em", "um", "para", "com", "uma", "no", "na", "por", "mais", "as", "dos", "foi"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "op", "te", "zijn", "voor", "met", "niet", "aan", "er", "ook", "als", "bij"},
+}
+
+// word -> languages it is common in
+var wordLanguages = func() map[string][]string {
+	index := make(map[string][]string)
+	for language, words := range languageWords {
+		for _, word := range words {
+			index[word] = append(index[word], language)
+		}
+	}
+	return index
+}()
+
+// how many words of a body are looked at, and how many must be common
+// words of the winning language before it is trusted
+const languageSampleWords = 500
+const minLanguageEvidence = 3
+
+// guesses the language of a body from its most common words
+func detectLanguage(body string) string {
+	counts := make(map[string]int)
+
+	words := strings.Fields(strings.ToLower(body))
+	for _, word := range words[:min(len(words), languageSampleWords)] {
+		word = strings.Trim(word, ".,;:!?\"'()[]")
+		for _, language := range wordLanguages[word] {
+			counts[language]++
+		}
+	}
+
+	best, bestCount := unknownAttribute, minLanguageEvidence-1
+	for language, count := range counts {
+		if count > bestCount || (count == bestCount && best != unknownAttribute && language < best) {
+			best, bestCount = language, count
+		}
+	}
+
+	return best
+}
+
+// content types by url extension, pages without a known extension are html
+var extensionContentTypes = map[string]string{
+	".pdf":  "application/pdf",
+	".txt":  "text/plain",
+	".xml":  "application/xml",
+	".json": "application/json",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".htm":  "text/html",
+	".html": "text/html",
+	".php":  "text/html",
+	".asp":  "text/html",
+	".aspx": "text/html",
+}
+
+// guesses the content type of a document from its url, the crawler does
+// not keep the response headers
+func detectContentType(rawUrl string) string {
+	parsed, err := url.Parse(strings.TrimSpace(rawUrl))
+	if err != nil {
+		return unknownAttribute
+	}
+
+	extension := strings.ToLower(path.Ext(parsed.Path))
+	contentType, known := extensionContentTypes[extension]
+	if known {
+		return contentType
+	}
+
+	return "text/html"
+}
@@ -20,6 +20,11 @@ var postingListAccumulator = make(map[string]map[int]int)
 var termToDocumentFrequency = make(map[string]int)
 var termToIdf = make(map[string]float64)
 
+// unstemmed word -> stemmed term and the number of documents using the
+// word, for suggesting completions of what users type
+var surfaceFormToTerm = make(map[string]string)
+var surfaceFormToDocumentFrequency = make(map[string]int)
+
 type Document struct {
 	docId int
 	url   string
@@ -134,10 +139,38 @@ func writeOutDictionary(ddb *sql.DB, totalDocs int) error {
 	return nil
 }
 
+func writeOutSurfaceForms(ddb *sql.DB) error {
+	fmt.Println("writeOutSurfaceForms() start")
+	tx, err := ddb.Begin()
+	if err != nil {
+		return err
+	}
+
+	// write out word -> term and document frequency
+	for surfaceForm, frequency := range surfaceFormToDocumentFrequency {
+		_, err := tx.Exec("INSERT INTO surfaceForms(word, term, documentFrequency) VALUES(?, ?, ?)", surfaceForm, surfaceFormToTerm[surfaceForm], frequency)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	clear(surfaceFormToTerm)
+	clear(surfaceFormToDocumentFrequency)
+
+	fmt.Println("writeOutSurfaceForms() end")
+	return nil
+}
+
 func (doc *Document) index(idb *sql.DB) error {
 	fmt.Println("Indexing ", doc.docId)
 	var docTerms []string
 	var wordToFreqency = make(map[string]int)
+	var surfaceForms = make(map[string]bool)
 
 	// loop through words in body of document
 	words := strings.Fields(doc.body)
@@ -153,6 +186,7 @@ func (doc *Document) index(idb *sql.DB) error {
 		if isStopWord {
 			continue
 		}
+		surfaceForm := word
 
 		// stem the word
 		common.SnowballEnv.SetCurrent(word)
@@ -161,6 +195,13 @@ func (doc *Document) index(idb *sql.DB) error {
 
 		docTerms = append(docTerms, word)
 		wordToFreqency[word]++
+
+		surfaceForms[surfaceForm] = true
+		surfaceFormToTerm[surfaceForm] = word
+	}
+
+	for surfaceForm := range surfaceForms {
+		surfaceFormToDocumentFrequency[surfaceForm]++
 	}
 
 	// update data structures for batch write
@@ -192,6 +233,14 @@ func (doc *Document) index(idb *sql.DB) error {
 		return err
 	}
 
+	// store the host for site filters and the attributes facets count
+	_, err = tx.Exec("INSERT INTO docIdToFields(docId, host, url, language, contentType) VALUES(?, ?, ?, ?, ?)",
+		doc.docId, common.HostOf(doc.url), strings.TrimSpace(doc.url), detectLanguage(doc.body), detectContentType(doc.url))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return err
 	}
@@ -232,6 +281,9 @@ func writeOutDocumentLengths(idb *sql.DB) error {
 	return nil
 }
 
+// also writes out each document's term vector, term -> frequency, which the
+// server compares documents with. It is written as soon as it is built so
+// only one document's vector is held at a time.
 func calculateDocumentLengths(idb *sql.DB) error {
 	fmt.Println("calculateDocumentLengths() start")
 
@@ -264,6 +316,8 @@ func calculateDocumentLengths(idb *sql.DB) error {
 			return err
 		}
 
+		termVector := make(map[string]int)
+
 		var documentLength float64
 		for _, term := range docTerms {
 			// get the frequency of term in document
@@ -292,6 +346,8 @@ func calculateDocumentLengths(idb *sql.DB) error {
 			if !frequencyOk {
 				continue
 			} else {
+				termVector[term] = frequency
+
 				if frequency > 0 {
 					tf = float64(1) + math.Log10(float64(frequency))
 				}
@@ -309,6 +365,18 @@ func calculateDocumentLengths(idb *sql.DB) error {
 		documentLength = math.Sqrt(documentLength)
 
 		docIdToLength[docId] = documentLength
+
+		jsonTermVector, err := json.Marshal(termVector)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO docIdToTermVector(docId, vector) VALUES(?, ?)", docId, jsonTermVector)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
 	}
 
 	if err = rows.Err(); err != nil {
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/KevinBasta/yam-search/common"
+)
+
+// each indexer run builds a new generation directory so a running search
+// server can keep reading the previous one until it swaps. This many
+// finished generations are kept on disk, since the server may still be
+// draining queries on the one before the newest, and the one the server
+// serves is kept as well however old it is.
+const keptGenerations = 2
+
+func generationPath(outDir string, name string) string {
+	return filepath.Join(outDir, common.GenerationsDir, name)
+}
+
+// points the marker at the finished generation
+func publishGeneration(outDir string, name string) error {
+	err := common.WriteMarker(outDir, common.GenerationMarker, name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("published generation", name)
+	return pruneGenerations(outDir)
+}
+
+// removes all but the newest keptGenerations generation directories and
+// the one being served, names sort by creation time
+func pruneGenerations(outDir string) error {
+	served, err := common.ReadMarker(outDir, common.ServedGenerationMarker)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(outDir, common.GenerationsDir))
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != served {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+
+	for len(names) > keptGenerations {
+		err := os.RemoveAll(generationPath(outDir, names[0]))
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("removed generation", names[0])
+		names = names[1:]
+	}
+
+	return nil
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/KevinBasta/yam-search/common"
 	_ "modernc.org/sqlite" // Import the SQLite driver
@@ -39,6 +41,22 @@ func createIndex(collectionDB string, indexDB string, dictionaryDB string) error
 		return err
 	}
 
+	// per document fields the server filters and counts facets on
+	_, err = idb.Exec("CREATE TABLE docIdToFields (docId INTEGER PRIMARY KEY, host TEXT, url TEXT, language TEXT, contentType TEXT);")
+	if err != nil {
+		return err
+	}
+
+	_, err = idb.Exec("CREATE INDEX docIdToFieldsHost ON docIdToFields(host);")
+	if err != nil {
+		return err
+	}
+
+	_, err = idb.Exec("CREATE TABLE docIdToTermVector (docId INTEGER PRIMARY KEY, vector TEXT);")
+	if err != nil {
+		return err
+	}
+
 	_, err = idb.Exec("CREATE TABLE metadata (key TEXT PRIMARY KEY, value INTEGER);")
 	if err != nil {
 		return err
@@ -56,6 +74,11 @@ func createIndex(collectionDB string, indexDB string, dictionaryDB string) error
 	if err != nil {
 		return err
 	}
+
+	_, err = ddb.Exec("CREATE TABLE surfaceForms (word TEXT PRIMARY KEY, term TEXT, documentFrequency INTEGER);")
+	if err != nil {
+		return err
+	}
 	defer ddb.Close()
 
 	// Index each document
@@ -84,7 +107,13 @@ func createIndex(collectionDB string, indexDB string, dictionaryDB string) error
 		return err
 	}
 
-	// Calculate document lengths
+	// Write out the unstemmed words for suggestions
+	err = writeOutSurfaceForms(ddb)
+	if err != nil {
+		return err
+	}
+
+	// Calculate document lengths and write out document term vectors
 	err = calculateDocumentLengths(idb)
 	if err != nil {
 		return err
@@ -96,7 +125,8 @@ func createIndex(collectionDB string, indexDB string, dictionaryDB string) error
 		return err
 	}
 
-	// Drop docIdToTerms table since it's no longer needed
+	// Drop docIdToTerms table since it's no longer needed, the term vectors
+	// keep each term once with its frequency
 	_, err = idb.Exec("DROP TABLE docIdToTerms;")
 	if err != nil {
 		return err
@@ -112,12 +142,23 @@ func createIndex(collectionDB string, indexDB string, dictionaryDB string) error
 }
 
 func main() {
+	outDir := "../out"
 	collectionDB := "../out/document_collection.db"
-	indexDB := "../out/index.db"
-	dictionaryDB := "../out/dictionary.db"
 	stopWordsPath := "../out/stopwords.txt"
 
-	err := common.LoadStopWords(stopWordsPath)
+	// build into a fresh generation directory, named in utc so names sort by
+	// build time across time zones and daylight saving changes
+	generationName := time.Now().UTC().Format("20060102-150405.000")
+	generationDir := generationPath(outDir, generationName)
+	err := os.MkdirAll(generationDir, 0755)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	indexDB := filepath.Join(generationDir, "index.db")
+	dictionaryDB := filepath.Join(generationDir, "dictionary.db")
+
+	err = common.LoadStopWords(stopWordsPath)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -128,6 +169,13 @@ func main() {
 	// }
 
 	err = createIndex(collectionDB, indexDB, dictionaryDB)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// let the search server know the generation is ready to be served
+	err = publishGeneration(outDir, generationName)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// whether callers on the same machine count as admins. Off by default since
+// a reverse proxy on the machine makes every request look local.
+var trustLoopback bool = false
+
+// restricts admin routes to callers holding an admin api key, or on the same
+// machine with -trust-loopback. Requests with an Origin come from a browser
+// page, which may be any site the machine's user opened, so they need the key.
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isLocal := trustLoopback && isLocalRequest(r) && r.Header.Get("Origin") == ""
+
+		isAdminKey := false
+		header := r.Header.Get("X-API-Key")
+		if apiKeys != nil && header != "" {
+			key, ok := apiKeys.lookup(header)
+			isAdminKey = ok && key.Admin
+		}
+
+		if !isLocal && !isAdminKey {
+			writeError(w, r, errForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// whether the request comes from the same machine
+func isLocalRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	return err == nil && ip != nil && ip.IsLoopback()
+}
+
+type reloadResponse struct {
+	Generation int64  `json:"generation"`
+	Name       string `json:"name"`
+}
+
+// loads the generation named by the marker file and swaps it in, queries
+// already running finish on the generation they started with
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	gen, err := reloadGeneration(false)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, reloadResponse{Generation: gen.id, Name: gen.name})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// layouts accepted for the ends of the time range, times without a zone
+// are utc
+var analyzeTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+// how often a query was searched, and its worst latency
+type queryCount struct {
+	Query        string
+	Count        int
+	MaxLatencyMs float64
+}
+
+// what analyze reports over a time range of the query log
+type queryLogReport struct {
+	From, To    time.Time
+	Queries     int
+	Clients     int
+	ZeroResults int
+	Partial     int
+	Failed      int
+	Slow        int
+	Latencies   []float64 // milliseconds, sorted once reading finishes
+	Top         []queryCount
+	TopZero     []queryCount
+	TopSlow     []queryCount
+	TopFailed   []queryCount
+}
+
+func parseAnalyzeTime(value string) (time.Time, error) {
+	for _, layout := range analyzeTimeLayouts {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%q is not a time like 2006-01-02, 2006-01-02T15:04 or RFC 3339", value)
+}
+
+// ./search analyze reads the query log and reports its top, zero result,
+// slow and failed queries and latency percentiles over a time range
+func runAnalyze(args []string) int {
+	flags := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	path := flags.String("query-log", queryLogPath, "query log to read, with the files rotated out of it")
+	fromParam := flags.String("from", "", "start of the time range, inclusive")
+	toParam := flags.String("to", "", "end of the time range, exclusive")
+	since := flags.Duration("since", 0, "report the last duration instead of -from, such as 24h")
+	top := flags.Int("top", 10, "queries listed in each section")
+	slow := flags.Duration("slow", 500*time.Millisecond, "latency from which a query counts as slow")
+	err := flags.Parse(args)
+	if err != nil {
+		return exitStartupFailed
+	}
+
+	var from, to time.Time
+	if *fromParam != "" {
+		from, err = parseAnalyzeTime(*fromParam)
+		if err != nil {
+			fmt.Println("-from:", err)
+			return exitStartupFailed
+		}
+	}
+	if *toParam != "" {
+		to, err = parseAnalyzeTime(*toParam)
+		if err != nil {
+			fmt.Println("-to:", err)
+			return exitStartupFailed
+		}
+	}
+	if *since > 0 {
+		from = time.Now().Add(-*since)
+	}
+
+	report, err := analyzeQueryLog(*path, from, to, *top, *slow)
+	if err != nil {
+		fmt.Println("reading query log:", err)
+		return exitStartupFailed
+	}
+
+	writeQueryLogReport(os.Stdout, report, *slow)
+	return exitOk
+}
+
+func analyzeQueryLog(path string, from time.Time, to time.Time, top int, slow time.Duration) (queryLogReport, error) {
+	report := queryLogReport{From: from, To: to}
+	counts := make(map[string]*queryCount)
+	zeroCounts := make(map[string]*queryCount)
+	slowCounts := make(map[string]*queryCount)
+	failedCounts := make(map[string]*queryCount)
+	clients := make(map[string]bool)
+	slowMs := float64(slow.Microseconds()) / 1000
+
+	count := func(counts map[string]*queryCount, query string, latencyMs float64) {
+		entry, ok := counts[query]
+		if !ok {
+			entry = &queryCount{Query: query}
+			counts[query] = entry
+		}
+		entry.Count++
+		entry.MaxLatencyMs = math.Max(entry.MaxLatencyMs, latencyMs)
+	}
+
+	err := readQueryLog(path, from, to, func(record queryLogRecord) {
+		query := normalizeQueryText(record.Query)
+
+		report.Queries++
+		clients[record.Client] = true
+		report.Latencies = append(report.Latencies, record.LatencyMs)
+		count(counts, query, record.LatencyMs)
+
+		if record.failed() {
+			report.Failed++
+			count(failedCounts, query, record.LatencyMs)
+		} else if record.Hits == 0 {
+			report.ZeroResults++
+			count(zeroCounts, query, record.LatencyMs)
+		}
+		if record.Partial {
+			report.Partial++
+		}
+		if record.LatencyMs >= slowMs {
+			report.Slow++
+			count(slowCounts, query, record.LatencyMs)
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+
+	report.Clients = len(clients)
+	slices.Sort(report.Latencies)
+	report.Top = topQueries(counts, top, func(a, b *queryCount) bool { return a.Count > b.Count })
+	report.TopZero = topQueries(zeroCounts, top, func(a, b *queryCount) bool { return a.Count > b.Count })
+	report.TopSlow = topQueries(slowCounts, top, func(a, b *queryCount) bool { return a.MaxLatencyMs > b.MaxLatencyMs })
+	report.TopFailed = topQueries(failedCounts, top, func(a, b *queryCount) bool { return a.Count > b.Count })
+
+	return report, nil
+}
+
+// the n queries ranking first by better, ties in query order
+func topQueries(counts map[string]*queryCount, n int, better func(a, b *queryCount) bool) []queryCount {
+	entries := make([]*queryCount, 0, len(counts))
+	for _, entry := range counts {
+		entries = append(entries, entry)
+	}
+
+	slices.SortFunc(entries, func(a, b *queryCount) int {
+		if better(a, b) {
+			return -1
+		} else if better(b, a) {
+			return 1
+		}
+		return strings.Compare(a.Query, b.Query)
+	})
+
+	var top []queryCount
+	for _, entry := range entries[:min(n, len(entries))] {
+		top = append(top, *entry)
+	}
+
+	return top
+}
+
+// nearest rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(0, rank-1)]
+}
+
+func writeQueryLogReport(out io.Writer, report queryLogReport, slow time.Duration) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	from, to := "the start", "now"
+	if !report.From.IsZero() {
+		from = report.From.UTC().Format(time.RFC3339)
+	}
+	if !report.To.IsZero() {
+		to = report.To.UTC().Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "queries from %s to %s\n\n", from, to)
+
+	share := func(n int) float64 {
+		if report.Queries == 0 {
+			return 0
+		}
+		return 100 * float64(n) / float64(report.Queries)
+	}
+	fmt.Fprintf(w, "queries\t%d\n", report.Queries)
+	fmt.Fprintf(w, "clients\t%d\n", report.Clients)
+	fmt.Fprintf(w, "zero results\t%d\t%.1f%%\n", report.ZeroResults, share(report.ZeroResults))
+	fmt.Fprintf(w, "partial\t%d\t%.1f%%\n", report.Partial, share(report.Partial))
+	fmt.Fprintf(w, "failed\t%d\t%.1f%%\n", report.Failed, share(report.Failed))
+	fmt.Fprintf(w, "slow (>= %s)\t%d\t%.1f%%\n", slow, report.Slow, share(report.Slow))
+
+	fmt.Fprintf(w, "\nlatency ms\tp50\tp90\tp95\tp99\tmax\n")
+	fmt.Fprintf(w, "\t%.1f\t%.1f\t%.1f\t%.1f\t%.1f\n",
+		percentile(report.Latencies, 50), percentile(report.Latencies, 90), percentile(report.Latencies, 95),
+		percentile(report.Latencies, 99), percentile(report.Latencies, 100))
+
+	sections := []struct {
+		title   string
+		queries []queryCount
+	}{
+		{"top queries", report.Top},
+		{"zero result queries", report.TopZero},
+		{"slow queries", report.TopSlow},
+		{"failed queries", report.TopFailed},
+	}
+	for _, section := range sections {
+		fmt.Fprintf(w, "\n%s\tcount\tmax ms\n", section.title)
+		for _, query := range section.queries {
+			fmt.Fprintf(w, "  %s\t%d\t%.1f\n", query.Query, query.Count, query.MaxLatencyMs)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// file holding issued api keys, authentication is off when it is empty
+var apiKeysPath string = ""
+
+// an issued key. Only a hash of the key is kept, the key itself is shown
+// once when it is issued.
+type apiKey struct {
+	Id         string    `json:"id"`
+	Name       string    `json:"name"`
+	Hash       string    `json:"hash"`
+	Admin      bool      `json:"admin"`
+	Rate       float64   `json:"rate,omitempty"`       // requests per second, 0 uses the server default
+	Burst      float64   `json:"burst,omitempty"`      // 0 uses the server default
+	DailyQuota int       `json:"dailyQuota,omitempty"` // requests per utc day, 0 is unlimited
+	Revoked    bool      `json:"revoked"`
+	Created    time.Time `json:"created"`
+	Usage      keyUsage  `json:"usage"`
+}
+
+type keyUsage struct {
+	Total    int       `json:"total"`
+	Day      string    `json:"day"` // utc day Today counts requests for
+	Today    int       `json:"today"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+type apiKeyFile struct {
+	Keys []*apiKey `json:"keys"`
+}
+
+type apiKeyStore struct {
+	mu     sync.Mutex
+	saveMu sync.Mutex // one writer of the file at a time
+	path   string
+	keys   []*apiKey
+	byHash map[string]*apiKey
+	dirty  bool
+}
+
+var apiKeys *apiKeyStore
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// reads the key file, a missing file starts an empty store that is created
+// when the first key is issued
+func loadAPIKeys(path string) (*apiKeyStore, error) {
+	store := &apiKeyStore{path: path, byHash: make(map[string]*apiKey)}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var file apiKeyFile
+	err = json.Unmarshal(content, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	store.keys = file.Keys
+	for _, key := range store.keys {
+		store.byHash[key.Hash] = key
+	}
+
+	return store, nil
+}
+
+// writes the keys and their usage back to the file, through a temporary
+// file so a crash never leaves it half written
+func (s *apiKeyStore) save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	content, err := json.MarshalIndent(apiKeyFile{Keys: s.keys}, "", "  ")
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	err = os.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.path)
+}
+
+// saves usage counters every interval while they change, until stop closes
+func (s *apiKeyStore) saveUsage(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		dirty := s.dirty
+		s.mu.Unlock()
+		if !dirty {
+			continue
+		}
+
+		err := s.save()
+		if err != nil {
+			fmt.Println("saving api key usage:", err)
+		}
+	}
+}
+
+// counts queries against key, failing when they do not fit in what is left
+// of its daily quota
+func (s *apiKeyStore) use(key *apiKey, queries int, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day := now.UTC().Format(time.DateOnly)
+	if key.Usage.Day != day {
+		key.Usage.Day = day
+		key.Usage.Today = 0
+	}
+
+	if key.DailyQuota > 0 && key.Usage.Today+queries > key.DailyQuota {
+		return errQuotaExceeded
+	}
+
+	key.Usage.Total += queries
+	key.Usage.Today += queries
+	key.Usage.LastUsed = now
+	s.dirty = true
+	return nil
+}
+
+func (s *apiKeyStore) lookup(key string) (*apiKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found, ok := s.byHash[hashAPIKey(key)]
+	if !ok || found.Revoked {
+		return nil, false
+	}
+
+	return found, true
+}
+
+// creates a key from the settings in template and returns the key itself,
+// which is not stored anywhere
+func (s *apiKeyStore) issue(template apiKey) (string, *apiKey, error) {
+	var secret [24]byte
+	_, err := rand.Read(secret[:])
+	if err != nil {
+		return "", nil, err
+	}
+	key := "yam_" + hex.EncodeToString(secret[:])
+
+	// the id is shown in listings and logs, so it is drawn separately and
+	// gives nothing of the key away
+	var id [8]byte
+	_, err = rand.Read(id[:])
+	if err != nil {
+		return "", nil, err
+	}
+
+	issued := template
+	issued.Id = hex.EncodeToString(id[:])
+	issued.Hash = hashAPIKey(key)
+	issued.Revoked = false
+	issued.Created = time.Now().UTC()
+	issued.Usage = keyUsage{}
+
+	s.mu.Lock()
+	s.keys = append(s.keys, &issued)
+	s.byHash[issued.Hash] = &issued
+	s.mu.Unlock()
+
+	return key, &issued, s.save()
+}
+
+func (s *apiKeyStore) revoke(id string) (apiKey, error) {
+	s.mu.Lock()
+	index := slices.IndexFunc(s.keys, func(key *apiKey) bool { return key.Id == id })
+	if index < 0 {
+		s.mu.Unlock()
+		return apiKey{}, errKeyNotFound
+	}
+	s.keys[index].Revoked = true
+	revoked := *s.keys[index]
+	s.mu.Unlock()
+
+	return revoked, s.save()
+}
+
+// copies of every key for listing, safe to encode while requests update
+// the originals
+func (s *apiKeyStore) list() []apiKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]apiKey, len(s.keys))
+	for i, key := range s.keys {
+		keys[i] = *key
+	}
+
+	return keys
+}
+
+type apiKeyContextKey struct{}
+
+// the key a request authenticated with, nil when authentication is off
+func apiKeyFrom(ctx context.Context) *apiKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return key
+}
+
+// when keys are configured, rejects requests without a valid key and passes
+// the key on to the rate limiter and withQuota
+func withAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiKeys == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := r.Header.Get("X-API-Key")
+		if header == "" {
+			writeError(w, r, errMissingAPIKey)
+			return
+		}
+
+		key, ok := apiKeys.lookup(header)
+		if !ok {
+			writeError(w, r, errInvalidAPIKey)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyContextKey{}, key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// counts a request against its key's daily quota. It goes after the rate
+// limiter so rejected requests do not use up the quota.
+func withQuota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chargeQuota(w, r, 1) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// counts each query a request runs against its key's daily quota,
+// answering it with an error when they do not fit. Reports whether the
+// request may go on.
+func chargeQuota(w http.ResponseWriter, r *http.Request, queries int) bool {
+	key := apiKeyFrom(r.Context())
+	if key == nil {
+		return true
+	}
+
+	now := time.Now()
+	err := apiKeys.use(key, queries, now)
+	if err != nil {
+		// quotas reset at the start of the next utc day
+		midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		w.Header().Set("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+		writeError(w, r, err)
+		return false
+	}
+
+	return true
+}
+
+type issueKeyRequest struct {
+	Name       string  `json:"name"`
+	Admin      bool    `json:"admin"`
+	Rate       float64 `json:"rate"`
+	Burst      float64 `json:"burst"`
+	DailyQuota int     `json:"dailyQuota"`
+}
+
+type issueKeyResponse struct {
+	Key    string `json:"key"`
+	Record apiKey `json:"record"`
+}
+
+type listKeysResponse struct {
+	Keys []apiKey `json:"keys"`
+}
+
+// GET lists keys with their usage, POST issues a new key
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	if apiKeys == nil {
+		writeError(w, r, errAuthDisabled)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, r, listKeysResponse{Keys: apiKeys.list()})
+	case http.MethodPost:
+		var request issueKeyRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&request)
+		if err != nil || request.Name == "" || request.Rate < 0 || request.Burst < 0 || request.DailyQuota < 0 {
+			writeError(w, r, errInvalidKeyRequest)
+			return
+		}
+
+		key, issued, err := apiKeys.issue(apiKey{
+			Name:       request.Name,
+			Admin:      request.Admin,
+			Rate:       request.Rate,
+			Burst:      request.Burst,
+			DailyQuota: request.DailyQuota,
+		})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		fmt.Println("issued api key", issued.Id, issued.Name)
+		writeJSONStatus(w, r, http.StatusCreated, issueKeyResponse{Key: key, Record: *issued})
+	default:
+		writeError(w, r, errMethodNotAllowed)
+	}
+}
+
+// DELETE revokes the key with the id in the path
+func revokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if apiKeys == nil {
+		writeError(w, r, errAuthDisabled)
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	key, err := apiKeys.revoke(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	fmt.Println("revoked api key", key.Id, key.Name)
+	writeJSON(w, r, key)
+}
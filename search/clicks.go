@@ -0,0 +1,421 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// file result clicks are appended to, rotated like the query log. Clicks
+// are only logged and used for ranking while the query log is on too.
+var clickLogPath string = "../out/clicks.log"
+
+// the route whose impressions are counted, the only one whose result links
+// go through /click
+const clickTrackedRoute = "/"
+
+// expected clicks a boost is smoothed with, so a single click does not
+// move a result far
+var clickSmoothing = 1.0
+
+// until a rank has been shown often, its click rate is assumed to fall off
+// as the rate at the top over the rank. This many impressions of the prior
+// are mixed into the click rate of every rank.
+var clickPriorRate = 0.3
+var clickPriorImpressions = 100.0
+
+// how far back clicks and impressions count, and how often older ones are
+// dropped and new ones folded into the boosts
+var clickWindow = 30 * 24 * time.Hour
+var clickRebuildInterval = time.Minute
+
+// results shown deeper than this are not tracked, clicks on them are ignored
+var maxClickRank = 100
+
+// a click only counts when the same client was shown the result at that
+// rank for the query within this long, and once until it is shown again
+var clickImpressionTTL = 30 * time.Minute
+
+// boosts are kept within [1/maxClickBoost, maxClickBoost] so clicks alone
+// cannot bury a result or lift it over every other
+var maxClickBoost = 4.0
+
+// one result followed from the search page
+type clickRecord struct {
+	Time   time.Time `json:"time"`
+	Query  string    `json:"query"`
+	DocId  int       `json:"docId"`
+	Rank   int       `json:"rank"` // position in the whole result list, from 1
+	Client string    `json:"client"`
+}
+
+var clickLogger *appendLog
+
+// clicks of each query and document weighed against how often the
+// document was shown and where. Top results are clicked more for being on
+// top, so a document's clicks are divided by the clicks an average result
+// gets at the positions it was shown at (clicks over expected clicks).
+// Counts are kept per utc day so days leaving the window can be dropped,
+// and boosts are rebuilt in the background and swapped in whole.
+type clickModel struct {
+	mu     sync.Mutex // guards days, shown and dirty
+	days   map[string]*clickCounts
+	shown  map[shownResult]time.Time // recent showings not clicked yet
+	dirty  bool
+	boosts atomic.Pointer[map[string]map[int]float64] // query -> docId -> clicks over expected clicks
+}
+
+// impressions and clicks of one utc day, or of the whole window
+type clickCounts struct {
+	rankImpressions map[int]int
+	rankClicks      map[int]int
+	impressions     map[string]map[int]map[int]int // query -> docId -> rank -> times shown
+	clicks          map[string]map[int]int         // query -> docId -> clicks
+}
+
+func newClickCounts() *clickCounts {
+	return &clickCounts{
+		rankImpressions: make(map[int]int),
+		rankClicks:      make(map[int]int),
+		impressions:     make(map[string]map[int]map[int]int),
+		clicks:          make(map[string]map[int]int),
+	}
+}
+
+func (counts *clickCounts) addImpression(query string, docId int, rank int, times int) {
+	counts.rankImpressions[rank] += times
+	if counts.impressions[query] == nil {
+		counts.impressions[query] = make(map[int]map[int]int)
+	}
+	if counts.impressions[query][docId] == nil {
+		counts.impressions[query][docId] = make(map[int]int)
+	}
+	counts.impressions[query][docId][rank] += times
+}
+
+func (counts *clickCounts) addClicks(query string, docId int, rank int, clicks int) {
+	counts.rankClicks[rank] += clicks
+	if counts.clicks[query] == nil {
+		counts.clicks[query] = make(map[int]int)
+	}
+	counts.clicks[query][docId] += clicks
+}
+
+// adds every count of other to counts
+func (counts *clickCounts) merge(other *clickCounts) {
+	for query, docs := range other.impressions {
+		for docId, ranks := range docs {
+			for rank, times := range ranks {
+				counts.addImpression(query, docId, rank, times)
+			}
+		}
+	}
+	for query, docs := range other.clicks {
+		if counts.clicks[query] == nil {
+			counts.clicks[query] = make(map[int]int)
+		}
+		for docId, clicks := range docs {
+			counts.clicks[query][docId] += clicks
+		}
+	}
+	for rank, clicks := range other.rankClicks {
+		counts.rankClicks[rank] += clicks
+	}
+}
+
+// a result shown to a client, what a click has to match
+type shownResult struct {
+	client string
+	query  string
+	docId  int
+	rank   int
+}
+
+// nil while the query or click log is off
+var clickBoosts *clickModel
+
+// reads the recent impressions of the query log and clicks of the click log
+func loadClickModel(queryLogPath string, clickLogPath string) (*clickModel, error) {
+	model := &clickModel{
+		days:  make(map[string]*clickCounts),
+		shown: make(map[shownResult]time.Time),
+	}
+	from := time.Now().Add(-clickWindow)
+
+	err := readQueryLog(queryLogPath, from, time.Time{}, model.addImpressionsLocked)
+	if err != nil {
+		return nil, err
+	}
+
+	err = readClickLog(clickLogPath, from, time.Time{}, func(record clickRecord) { model.addClickLocked(record) })
+	if err != nil {
+		return nil, err
+	}
+
+	model.maintain(time.Now())
+	return model, nil
+}
+
+func clickTracked(rank int) bool {
+	return rank >= 1 && rank <= maxClickRank
+}
+
+// calls fn with every click logged in [from, to)
+func readClickLog(path string, from time.Time, to time.Time, fn func(clickRecord)) error {
+	return readAppendLog(path, from, func(line []byte) {
+		var record clickRecord
+		err := json.Unmarshal(line, &record)
+		if err != nil {
+			return
+		}
+
+		if inTimeRange(record.Time, from, to) {
+			fn(record)
+		}
+	})
+}
+
+func (model *clickModel) addImpressions(record queryLogRecord) {
+	// most queries come from routes whose results are not clicked through
+	if model == nil || record.Route != clickTrackedRoute || len(record.TopDocIds) == 0 {
+		return
+	}
+
+	model.mu.Lock()
+	defer model.mu.Unlock()
+
+	model.addImpressionsLocked(record)
+}
+
+// the counts of the utc day t falls on
+func (model *clickModel) day(t time.Time) *clickCounts {
+	day := t.UTC().Format(time.DateOnly)
+	counts, ok := model.days[day]
+	if !ok {
+		counts = newClickCounts()
+		model.days[day] = counts
+	}
+
+	return counts
+}
+
+func (model *clickModel) addImpressionsLocked(record queryLogRecord) {
+	if record.Route != clickTrackedRoute {
+		return
+	}
+
+	query := normalizeQueryText(record.Query)
+	counts := model.day(record.Time)
+	for i, docId := range record.TopDocIds {
+		rank := record.Offset + i + 1
+		if !clickTracked(rank) {
+			break
+		}
+		counts.addImpression(query, docId, rank, 1)
+		model.shown[shownResult{record.Client, query, docId, rank}] = record.Time
+	}
+	model.dirty = true
+}
+
+// counts a click and reports whether it matched a showing of the result,
+// clicks that did not are ignored
+func (model *clickModel) addClick(record clickRecord) bool {
+	if model == nil {
+		return false
+	}
+
+	model.mu.Lock()
+	defer model.mu.Unlock()
+
+	return model.addClickLocked(record)
+}
+
+func (model *clickModel) addClickLocked(record clickRecord) bool {
+	query := normalizeQueryText(record.Query)
+	shown := shownResult{record.Client, query, record.DocId, record.Rank}
+	shownAt, ok := model.shown[shown]
+	if !ok || record.Time.Sub(shownAt) > clickImpressionTTL {
+		return false
+	}
+	delete(model.shown, shown)
+
+	model.day(record.Time).addClicks(query, record.DocId, record.Rank, 1)
+	model.dirty = true
+	return true
+}
+
+// chance an average result is clicked at rank
+func (counts *clickCounts) rankClickRate(rank int) float64 {
+	shown := float64(max(counts.rankImpressions[rank], counts.rankClicks[rank]))
+	prior := clickPriorRate / float64(rank)
+
+	return (float64(counts.rankClicks[rank]) + clickPriorImpressions*prior) / (shown + clickPriorImpressions)
+}
+
+// drops the days and showings that have left the window, then rebuilds
+// the boosts if anything changed
+func (model *clickModel) maintain(now time.Time) {
+	model.mu.Lock()
+	oldest := now.Add(-clickWindow).UTC().Format(time.DateOnly)
+	for day := range model.days {
+		if day < oldest {
+			delete(model.days, day)
+			model.dirty = true
+		}
+	}
+	for shown, shownAt := range model.shown {
+		if now.Sub(shownAt) > clickImpressionTTL {
+			delete(model.shown, shown)
+		}
+	}
+
+	if !model.dirty && model.boosts.Load() != nil {
+		model.mu.Unlock()
+		return
+	}
+
+	window := newClickCounts()
+	for _, counts := range model.days {
+		window.merge(counts)
+	}
+	model.dirty = false
+	model.mu.Unlock()
+
+	boosts := window.boosts()
+	model.boosts.Store(&boosts)
+}
+
+// maintains the model every interval until stop is closed
+func (model *clickModel) maintainEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			model.maintain(now)
+		}
+	}
+}
+
+// computes every boost. Both clicks and expected clicks are smoothed, so
+// documents with little data stay near 1, documents shown but never clicked
+// sink below it and documents clicked more than their positions predict
+// rise above it.
+func (counts *clickCounts) boosts() map[string]map[int]float64 {
+	boosts := make(map[string]map[int]float64)
+	boost := func(query string, docId int) {
+		if boosts[query] == nil {
+			boosts[query] = make(map[int]float64)
+		}
+		if _, done := boosts[query][docId]; done {
+			return
+		}
+
+		var expected float64
+		for rank, shown := range counts.impressions[query][docId] {
+			expected += float64(shown) * counts.rankClickRate(rank)
+		}
+		clicks := float64(counts.clicks[query][docId])
+
+		boost := (clicks + clickSmoothing) / (expected + clickSmoothing)
+		boosts[query][docId] = math.Min(maxClickBoost, math.Max(1/maxClickBoost, boost))
+	}
+
+	for query, docs := range counts.impressions {
+		for docId := range docs {
+			boost(query, docId)
+		}
+	}
+	for query, docs := range counts.clicks {
+		for docId := range docs {
+			boost(query, docId)
+		}
+	}
+
+	return boosts
+}
+
+// docId -> click boost for a query, documents without clicks or impressions
+// are missing. New clicks show up once the model is next maintained.
+// Callers must not modify the returned map.
+func (model *clickModel) forQuery(text string) map[int]float64 {
+	if model == nil {
+		return nil
+	}
+
+	boosts := model.boosts.Load()
+	if boosts == nil {
+		return nil
+	}
+
+	return (*boosts)[normalizeQueryText(text)]
+}
+
+// GET /click?q=&docId=&rank= records that the result at rank was followed
+// for q and redirects to the document
+func clickHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if strings.TrimSpace(query) == "" {
+		writeError(w, r, errEmptyQuery)
+		return
+	}
+
+	docId, err := strconv.Atoi(r.URL.Query().Get("docId"))
+	if err != nil {
+		writeError(w, r, errInvalidDocId)
+		return
+	}
+
+	rank, err := strconv.Atoi(r.URL.Query().Get("rank"))
+	if err != nil || !clickTracked(rank) {
+		writeError(w, r, invalidRequest("rank must be between 1 and %d", maxClickRank))
+		return
+	}
+
+	gen, err := acquireGeneration()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer gen.release()
+
+	// only urls of the collection are redirected to
+	var url string
+	row := gen.cdb.QueryRowContext(r.Context(), "SELECT url FROM docIdToData WHERE docId = ?", docId)
+	err = row.Scan(&url)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, r, errDocumentNotFound)
+		return
+	} else if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if clickLogger != nil {
+		record := clickRecord{
+			Time:   time.Now().UTC(),
+			Query:  query,
+			DocId:  docId,
+			Rank:   rank,
+			Client: clientId(r),
+		}
+		// only clicks on results the client was shown are logged
+		if clickBoosts.addClick(record) {
+			clickLogger.append(record)
+		}
+	}
+
+	http.Redirect(w, r, strings.TrimSpace(url), http.StatusFound)
+	fmt.Println("followed click:", query, "docId:", docId, "rank:", rank)
+}
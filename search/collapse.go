@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// ways results can be grouped when collapsing
+const (
+	collapseHost   = "host"   // one group per host
+	collapsePrefix = "prefix" // one group per host and first path segment
+)
+
+// how many results of one group a page may show
+type collapseOptions struct {
+	Field    string // empty disables collapsing
+	PerGroup int
+}
+
+var defaultPerGroup = 2
+
+func checkCollapse(options collapseOptions) error {
+	if options.Field != "" && options.Field != collapseHost && options.Field != collapsePrefix {
+		return invalidRequest("collapse must be %q or %q", collapseHost, collapsePrefix)
+	}
+
+	if options.PerGroup < 1 || options.PerGroup > maxLimit {
+		return invalidRequest("perGroup must be between 1 and %d", maxLimit)
+	}
+
+	return nil
+}
+
+// the group a document collapses into
+func collapseGroup(document documentFields, field string) string {
+	if field == collapseHost {
+		return document.Host
+	}
+
+	parsed, err := url.Parse(document.Url)
+	if err != nil {
+		return document.Host
+	}
+
+	segment, _, _ := strings.Cut(strings.TrimPrefix(parsed.Path, "/"), "/")
+	return document.Host + "/" + segment
+}
+
+// walks the ranked documents keeping at most PerGroup of each group, so
+// pages cut from the kept list are full. Returns the kept documents, the
+// group of each and how many documents of each group were dropped.
+func collapseResults(fields map[int]documentFields, rankedDocIds []int, options collapseOptions) ([]int, map[int]string, map[string]int) {
+	var kept []int
+	docIdToGroup := make(map[int]string)
+	groupToKept := make(map[string]int)
+	groupToHidden := make(map[string]int)
+
+	for _, docId := range rankedDocIds {
+		group := collapseGroup(fields[docId], options.Field)
+		if groupToKept[group] >= options.PerGroup {
+			groupToHidden[group]++
+			continue
+		}
+
+		groupToKept[group]++
+		docIdToGroup[docId] = group
+		kept = append(kept, docId)
+	}
+
+	return kept, docIdToGroup, groupToHidden
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// origins allowed to call the api from a browser, "null" is what pages
+// opened from disk such as test/test.html send and "*" allows any origin
+var corsAllowedOrigins = []string{"null"}
+var corsAllowedMethods = []string{http.MethodGet, http.MethodPost, http.MethodOptions}
+var corsAllowedHeaders = []string{"Content-Type", "X-Request-Id", "X-API-Key"}
+var corsMaxAge time.Duration = 10 * time.Minute
+
+func corsOriginAllowed(origin string) bool {
+	return origin != "" && (slices.Contains(corsAllowedOrigins, "*") || slices.Contains(corsAllowedOrigins, origin))
+}
+
+// adds cors headers for allowed origins and answers preflight requests
+// before they reach the route's handler
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// responses differ by origin so shared caches must key on it
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		allowed := corsOriginAllowed(origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-Id, Retry-After")
+		}
+
+		isPreflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !isPreflight {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(corsAllowedMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// splits a comma separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -6,27 +6,27 @@ import (
 	_ "modernc.org/sqlite" // Import the SQLite driver
 )
 
-// term -> idf (inverse document frequency)
-var dictionary = make(map[string]float64)
+// loads term -> idf (inverse document frequency)
+func loadDictionary(dictionaryDB string) (map[string]float64, error) {
+	var dictionary = make(map[string]float64)
 
-func loadDictionary(dictionaryDB string) error {
 	// open db
 	ddb, derr := sql.Open("sqlite", dictionaryDB)
 	if derr != nil {
-		return derr
+		return nil, derr
 	}
 	defer ddb.Close()
 
 	tx, err := ddb.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// query for all terms
 	rows, err := tx.Query("SELECT * FROM termToIdf;")
 	if err != nil {
 		_ = tx.Rollback()
-		return err
+		return nil, err
 	}
 	defer rows.Close()
 
@@ -36,7 +36,7 @@ func loadDictionary(dictionaryDB string) error {
 		var idf float64
 		if err := rows.Scan(&term, &idf); err != nil {
 			_ = tx.Rollback()
-			return err
+			return nil, err
 		}
 
 		// calculate idf and set it to the term in dict
@@ -45,29 +45,24 @@ func loadDictionary(dictionaryDB string) error {
 
 	if err = rows.Err(); err != nil {
 		_ = tx.Rollback()
-		return err
+		return nil, err
 	}
 
 	if err := tx.Commit(); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return dictionary, nil
 }
 
-// func loadTotalDocs(indexDB string) (int, error) {
-// 	idb, ierr := sql.Open("sqlite", indexDB)
-// 	if ierr != nil {
-// 		return 0, ierr
-// 	}
-// 	defer idb.Close()
-
-// 	var totalDocs int
-// 	entry := idb.QueryRow("SELECT value FROM metadata WHERE key = ?", "totalDocs")
-// 	err := entry.Scan(&totalDocs)
-// 	if err != nil {
-// 		return 0, err
-// 	}
+// total number of documents indexed, from the index metadata
+func loadTotalDocs(idb *sql.DB) (int, error) {
+	var totalDocs int
+	entry := idb.QueryRow("SELECT value FROM metadata WHERE key = ?", "totalDocs")
+	err := entry.Scan(&totalDocs)
+	if err != nil {
+		return 0, err
+	}
 
-// 	return totalDocs, nil
-// }
+	return totalDocs, nil
+}
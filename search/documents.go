@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// terms listed in a document's index statistics
+var documentTopTerms = 20
+
+type documentTerm struct {
+	Term      string  `json:"term"`
+	Frequency int     `json:"frequency"`
+	Weight    float64 `json:"weight"` // tf * idf
+}
+
+// how the index sees a document
+type documentStats struct {
+	Length          float64        `json:"length"` // vector length used for cosine similarity
+	DistinctTerms   int            `json:"distinctTerms"`
+	TermOccurrences int            `json:"termOccurrences"`
+	TopTerms        []documentTerm `json:"topTerms"`
+}
+
+// a stored document with what the index knows about it
+type documentRecord struct {
+	DocId       int           `json:"docId"`
+	Url         string        `json:"url"`
+	Title       string        `json:"title"`
+	Body        string        `json:"body"`
+	Pagerank    float64       `json:"pagerank"`
+	Host        string        `json:"host,omitempty"`
+	Language    string        `json:"language,omitempty"`
+	ContentType string        `json:"contentType,omitempty"`
+	Stats       documentStats `json:"stats"`
+}
+
+// reads a document from the collection and its statistics from the index
+func getDocument(ctx context.Context, gen *indexGeneration, docId int) (documentRecord, error) {
+	document := documentRecord{DocId: docId}
+
+	row := gen.cdb.QueryRowContext(ctx, "SELECT url, title, body, pagerank FROM docIdToData WHERE docId = ?", docId)
+	err := row.Scan(&document.Url, &document.Title, &document.Body, &document.Pagerank)
+	if errors.Is(err, sql.ErrNoRows) {
+		return document, errDocumentNotFound
+	} else if err != nil {
+		return document, searchContextError(ctx, err)
+	}
+	document.Url = strings.TrimSpace(document.Url)
+	document.Title = strings.TrimSpace(document.Title)
+
+	fields, hasFields := gen.fields[docId]
+	if hasFields {
+		document.Host, document.Language, document.ContentType = fields.Host, fields.Language, fields.ContentType
+	}
+
+	// documents past the indexed range have no statistics
+	length, err := getDocumentLength(ctx, gen.idb, docId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return document, nil
+	} else if err != nil {
+		return document, searchContextError(ctx, err)
+	}
+	document.Stats.Length = length
+	document.Stats.TopTerms = []documentTerm{}
+
+	if !gen.termVectors {
+		return document, nil
+	}
+
+	frequencies, err := getTermFrequencies(ctx, gen.idb, docId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return document, searchContextError(ctx, err)
+	}
+
+	for term, frequency := range frequencies {
+		document.Stats.DistinctTerms++
+		document.Stats.TermOccurrences += frequency
+		document.Stats.TopTerms = append(document.Stats.TopTerms, documentTerm{
+			Term:      term,
+			Frequency: frequency,
+			Weight:    logTermFrequency(frequency) * gen.dictionary[term],
+		})
+	}
+
+	slices.SortFunc(document.Stats.TopTerms, func(a, b documentTerm) int {
+		if a.Weight != b.Weight {
+			if a.Weight > b.Weight {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Term, b.Term)
+	})
+	document.Stats.TopTerms = document.Stats.TopTerms[:min(documentTopTerms, len(document.Stats.TopTerms))]
+
+	return document, nil
+}
+
+// the docId in the path, or looked up from the url parameter when the
+// path has none
+func documentIdFrom(ctx context.Context, r *http.Request, gen *indexGeneration) (int, error) {
+	idParam := r.PathValue("id")
+	if idParam != "" {
+		docId, err := strconv.Atoi(idParam)
+		if err != nil {
+			return 0, errInvalidDocId
+		}
+		return docId, nil
+	}
+
+	urlParam := r.URL.Query().Get("url")
+	if urlParam == "" {
+		return 0, invalidRequest("a document id in the path or a url parameter is required")
+	}
+
+	return lookupDocId(ctx, gen, urlParam)
+}
+
+// GET /doc/{id} or /doc?url= returns the stored document and its index
+// statistics
+func docHandler(w http.ResponseWriter, r *http.Request) {
+	gen, err := acquireGeneration()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer gen.release()
+
+	ctx, cancel, err := searchContext(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer cancel()
+
+	docId, err := documentIdFrom(ctx, r, gen)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	document, err := getDocument(ctx, gen, docId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, document)
+	fmt.Println("served document:", docId)
+}
+
+type cachePage struct {
+	Query string
+	Error string
+	Url   string
+	Title string
+	Body  template.HTML
+}
+
+// GET /cache/{id}?q= renders the stored body of a document with the query
+// terms highlighted
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	page := cachePage{Query: r.URL.Query().Get("q")}
+
+	status, err := runCache(r, &page)
+	if err != nil {
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) {
+			apiErr = errInternal
+		}
+		fmt.Println("request", requestIdFrom(r.Context()), "failed:", r.URL.Path, err)
+
+		page.Error = apiErr.Message
+		renderPage(w, r, cacheTemplate, apiErr.Status, page)
+		return
+	}
+
+	renderPage(w, r, cacheTemplate, status, page)
+	fmt.Println("served cached page:", r.PathValue("id"))
+}
+
+func runCache(r *http.Request, page *cachePage) (int, error) {
+	docId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return 0, errInvalidDocId
+	}
+
+	// the page still renders without highlights when q has no terms
+	query := searchQuery{Text: page.Query}
+	if strings.TrimSpace(query.Text) != "" {
+		err := compileQueryText(&query)
+		if err != nil && !errors.Is(err, errNoQueryTerms) {
+			return 0, err
+		}
+	}
+
+	gen, err := acquireGeneration()
+	if err != nil {
+		return 0, err
+	}
+	defer gen.release()
+
+	ctx, cancel, err := searchContext(r)
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	var body string
+	row := gen.cdb.QueryRowContext(ctx, "SELECT url, title, body FROM docIdToData WHERE docId = ?", docId)
+	err = row.Scan(&page.Url, &page.Title, &body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errDocumentNotFound
+	} else if err != nil {
+		return 0, searchContextError(ctx, err)
+	}
+
+	page.Url = strings.TrimSpace(page.Url)
+	page.Title = strings.TrimSpace(page.Title)
+	page.Body = highlight(body, query.Terms)
+
+	return http.StatusOK, nil
+}
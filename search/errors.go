@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// error returned to api clients, code is stable for frontends to switch on
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errEmptyQuery             = &apiError{http.StatusBadRequest, "empty_query", "query parameter q is required"}
+	errNoQueryTerms           = &apiError{http.StatusBadRequest, "no_query_terms", "query contains no searchable terms"}
+	errInvalidDocId           = &apiError{http.StatusBadRequest, "invalid_doc_id", "docId must be an integer"}
+	errDocumentNotFound       = &apiError{http.StatusNotFound, "document_not_found", "no document with that id"}
+	errTooManyTerms           = &apiError{http.StatusBadRequest, "too_many_terms", "query has more distinct terms than allowed"}
+	errRateLimited            = &apiError{http.StatusTooManyRequests, "rate_limited", "too many requests, retry after the time in Retry-After"}
+	errInvalidKeyRequest      = &apiError{http.StatusBadRequest, "invalid_key_request", "body must be json with a name and non-negative limits"}
+	errMissingAPIKey          = &apiError{http.StatusUnauthorized, "missing_api_key", "an api key is required in the X-API-Key header"}
+	errInvalidAPIKey          = &apiError{http.StatusUnauthorized, "invalid_api_key", "the api key is unknown or revoked"}
+	errKeyNotFound            = &apiError{http.StatusNotFound, "key_not_found", "no api key with that id"}
+	errAuthDisabled           = &apiError{http.StatusNotFound, "auth_disabled", "api keys are not enabled on this server"}
+	errQuotaExceeded          = &apiError{http.StatusTooManyRequests, "quota_exceeded", "the daily quota for this api key is used up"}
+	errFieldsUnavailable      = &apiError{http.StatusBadRequest, "filters_unavailable", "the served index has no document fields, rebuild it to filter, facet or collapse results"}
+	errTermVectorsUnavailable = &apiError{http.StatusBadRequest, "term_vectors_unavailable", "the served index has no document term vectors, rebuild it to compare documents"}
+	errSuggestionsUnavailable = &apiError{http.StatusBadRequest, "suggestions_unavailable", "the served index has no unstemmed words, rebuild it to suggest completions"}
+	errUnknownProfile         = &apiError{http.StatusBadRequest, "unknown_profile", "no ranking profile with that name"}
+	errRankingOverride        = &apiError{http.StatusForbidden, "ranking_override_forbidden", "ranking overrides require an api key"}
+	errInvalidPaging          = &apiError{http.StatusBadRequest, "invalid_paging", "offset must be a non-negative integer and limit between 1 and 100"}
+	errInvalidTimeout         = &apiError{http.StatusBadRequest, "invalid_timeout", "timeout must be a positive duration such as 500ms"}
+	errIndexUnavailable       = &apiError{http.StatusServiceUnavailable, "index_unavailable", "the search index is not loaded"}
+	errSearchTimeout          = &apiError{http.StatusGatewayTimeout, "search_timeout", "the search did not finish within its time budget"}
+	errForbidden              = &apiError{http.StatusForbidden, "forbidden", "this endpoint is not available to the caller"}
+	errMethodNotAllowed       = &apiError{http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed for this endpoint"}
+	errInternal               = &apiError{http.StatusInternalServerError, "internal_error", "an internal error occurred"}
+)
+
+type errorResponse struct {
+	Error     *apiError `json:"error"`
+	RequestId string    `json:"requestId"`
+}
+
+type requestIdKey struct{}
+
+// attaches a request id to the context and response headers, reusing the
+// caller's X-Request-Id when one is sent
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get("X-Request-Id")
+		if requestId == "" {
+			requestId = newRequestId()
+		}
+
+		w.Header().Set("X-Request-Id", requestId)
+		ctx := context.WithValue(r.Context(), requestIdKey{}, requestId)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestId() string {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b[:])
+}
+
+func requestIdFrom(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// logs the failure with its request id and writes a json error body, any
+// error that is not an apiError is reported as an internal error
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	requestId := requestIdFrom(r.Context())
+
+	// nobody is left to read a response for a cancelled request
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("request", requestId, "cancelled:", r.URL.Path)
+		return
+	}
+
+	fmt.Println("request", requestId, "failed:", r.URL.Path, err)
+
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		apiErr = errInternal
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+
+	response := errorResponse{
+		Error:     apiErr,
+		RequestId: requestId,
+	}
+
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		fmt.Println("request", requestId, "failed to write error:", err)
+	}
+}
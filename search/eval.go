@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/KevinBasta/yam-search/common"
+)
+
+// a query of the topics file
+type evalTopic struct {
+	Id    string
+	Query string
+}
+
+// a ranking profile run against a generation, the generation named by the
+// marker when empty
+type evalConfig struct {
+	Label      string
+	Generation string
+	Profile    string
+}
+
+// how well the ranked results of one topic match its judgments
+type topicScores struct {
+	Topic            string
+	Relevant         int
+	Partial          bool
+	Failed           string  // error code of a search that failed, scored as if nothing was found
+	Precision        float64 // at k
+	AveragePrecision float64
+	ReciprocalRank   float64
+	NDCG             float64 // at k
+}
+
+// means over the judged topics, which are the ones with a relevant document
+type evalSummary struct {
+	Config   evalConfig
+	Topics   []topicScores
+	Judged   int
+	Failed   int
+	MeanP    float64
+	MAP      float64
+	MRR      float64
+	MeanNDCG float64
+}
+
+var topicBlock = regexp.MustCompile(`(?s)<top>(.*?)</top>`)
+var topicNum = regexp.MustCompile(`<num>\s*(?:Number:)?\s*([^\s<]+)`)
+var topicTitle = regexp.MustCompile(`(?s)<title>\s*(?:Topic:)?\s*([^<]*)`)
+
+func parseTopics(path string) ([]evalTopic, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return readTopics(content)
+}
+
+// reads TREC topics, the title of each becomes its query. Files without
+// <top> blocks hold one topic per line, its id then its query.
+func readTopics(content []byte) ([]evalTopic, error) {
+	var topics []evalTopic
+	if topicBlock.Match(content) {
+		for _, block := range topicBlock.FindAllSubmatch(content, -1) {
+			num, title := topicNum.FindSubmatch(block[1]), topicTitle.FindSubmatch(block[1])
+			if num == nil || title == nil {
+				return nil, fmt.Errorf("topic without a <num> or <title>: %.60q", block[1])
+			}
+			topics = append(topics, evalTopic{string(num[1]), strings.Join(strings.Fields(string(title[1])), " ")})
+		}
+
+		return topics, nil
+	}
+
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		split := strings.IndexAny(line, " \t")
+		if split < 0 {
+			return nil, fmt.Errorf("line %d: expected a topic id and a query", i+1)
+		}
+		topics = append(topics, evalTopic{line[:split], strings.TrimSpace(line[split+1:])})
+	}
+
+	return topics, nil
+}
+
+func parseQrels(ctx context.Context, path string, gen *indexGeneration) (map[string]map[int]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readQrels(f, path, func(url string) (int, error) { return lookupDocId(ctx, gen, url) })
+}
+
+// reads TREC qrels lines of topic, iteration, document and relevance into
+// topic -> docId -> relevance. Documents are docIds, or urls of the
+// collection that lookup turns into docIds.
+func readQrels(r io.Reader, path string, lookup func(url string) (int, error)) (map[string]map[int]int, error) {
+	qrels := make(map[string]map[int]int)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("%s line %d: expected topic, iteration, document and relevance", path, line)
+		}
+
+		relevance, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: relevance must be an integer", path, line)
+		}
+
+		docId, err := strconv.Atoi(fields[2])
+		if err != nil {
+			docId, err = lookup(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: document %s: %w", path, line, fields[2], err)
+			}
+		}
+
+		if qrels[fields[0]] == nil {
+			qrels[fields[0]] = make(map[int]int)
+		}
+		qrels[fields[0]][docId] = relevance
+	}
+
+	return qrels, scanner.Err()
+}
+
+// scores a ranked list against the judgments of its topic, unjudged
+// documents count as not relevant
+func scoreTopic(ranked []int, judgments map[int]int, k int) topicScores {
+	var scores topicScores
+
+	var grades []int
+	for _, relevance := range judgments {
+		if relevance > 0 {
+			scores.Relevant++
+			grades = append(grades, relevance)
+		}
+	}
+	if scores.Relevant == 0 {
+		return scores
+	}
+
+	var found int
+	var dcg float64
+	for i, docId := range ranked {
+		relevance := judgments[docId]
+		if relevance <= 0 {
+			continue
+		}
+
+		found++
+		scores.AveragePrecision += float64(found) / float64(i+1)
+		if scores.ReciprocalRank == 0 {
+			scores.ReciprocalRank = 1 / float64(i+1)
+		}
+		if i < k {
+			scores.Precision++
+			dcg += gain(relevance, i)
+		}
+	}
+	scores.AveragePrecision /= float64(scores.Relevant)
+	scores.Precision /= float64(k)
+
+	// the ideal ranking puts the most relevant documents first
+	slices.SortFunc(grades, func(a, b int) int { return b - a })
+	var idealDcg float64
+	for i, relevance := range grades[:min(k, len(grades))] {
+		idealDcg += gain(relevance, i)
+	}
+	scores.NDCG = dcg / idealDcg
+
+	return scores
+}
+
+// discounted gain of a document with relevance at the zero based rank i
+func gain(relevance int, i int) float64 {
+	return (math.Pow(2, float64(relevance)) - 1) / math.Log2(float64(i+2))
+}
+
+// runs every topic through search with the config's profile, each under the
+// usual time budget, and scores the top depth results. A topic whose search
+// fails is recorded with its error and scored as if nothing was found.
+func evaluate(gen *indexGeneration, config evalConfig, topics []evalTopic, qrels map[string]map[int]int, k int, depth int) (evalSummary, error) {
+	summary := evalSummary{Config: config}
+
+	ranking, err := lookupProfile(config.Profile)
+	if err != nil {
+		return summary, fmt.Errorf("profile %q: %w", config.Profile, err)
+	}
+
+	for _, topic := range topics {
+		query := defaultSearchQuery()
+		query.Text = topic.Query
+		query.Ranking = ranking
+		query.Limit = depth
+		query.Highlight.Snippet = false
+
+		var ranked []int
+		var partial bool
+		err := compileQueryText(&query)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), searchTimeout)
+			var results searchResults
+			results, err = search(ctx, gen, query)
+			cancel()
+
+			for _, result := range results.Results {
+				ranked = append(ranked, result.DocId)
+			}
+			partial = results.Partial
+		}
+
+		scores := scoreTopic(ranked, qrels[topic.Id], k)
+		scores.Topic, scores.Partial = topic.Id, partial
+		if err != nil && !errors.Is(err, errNoQueryTerms) {
+			_, scores.Failed = queryLogStatus(err)
+			summary.Failed++
+			fmt.Println("topic", topic.Id, "failed:", err)
+		}
+		summary.Topics = append(summary.Topics, scores)
+
+		if scores.Relevant == 0 {
+			continue
+		}
+		summary.Judged++
+		summary.MeanP += scores.Precision
+		summary.MAP += scores.AveragePrecision
+		summary.MRR += scores.ReciprocalRank
+		summary.MeanNDCG += scores.NDCG
+	}
+
+	if summary.Judged > 0 {
+		n := float64(summary.Judged)
+		summary.MeanP, summary.MAP, summary.MRR, summary.MeanNDCG = summary.MeanP/n, summary.MAP/n, summary.MRR/n, summary.MeanNDCG/n
+	}
+
+	return summary, nil
+}
+
+// opens a generation the way the server does, by the marker when unnamed
+func openEvalGeneration(name string) (*indexGeneration, error) {
+	if name == "" {
+		var err error
+		name, err = readGenerationMarker()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return openGeneration(name)
+}
+
+// ./search eval runs the topics through search in process and reports
+// P@k, MAP, MRR and nDCG@k against the qrels, side by side for a second
+// configuration when one is given
+func runEval(args []string) int {
+	flags := flag.NewFlagSet("eval", flag.ContinueOnError)
+	topicsPath := flags.String("topics", "", "TREC topics file, or lines of a topic id and its query")
+	qrelsPath := flags.String("qrels", "", "TREC qrels file judging docIds or urls")
+	k := flags.Int("k", 10, "rank cutoff of precision and nDCG")
+	depth := flags.Int("depth", 100, "results retrieved per topic for MAP and MRR")
+	profile := flags.String("profile", defaultProfileName, "ranking profile of the configuration")
+	generation := flags.String("generation", "", "index generation of the configuration, the marker's when empty")
+	compareProfile := flags.String("compare-profile", "", "ranking profile of a second configuration to compare with")
+	compareGeneration := flags.String("compare-generation", "", "index generation of the second configuration")
+	flags.StringVar(&rankingProfilesPath, "ranking-profiles", rankingProfilesPath, "json file of named ranking profiles")
+	flags.DurationVar(&searchTimeout, "timeout", searchTimeout, "time budget of each query")
+	err := flags.Parse(args)
+	if err != nil {
+		return exitStartupFailed
+	}
+	if *topicsPath == "" || *qrelsPath == "" || *k < 1 || *depth < *k {
+		fmt.Println("eval needs -topics and -qrels, with 1 <= -k <= -depth")
+		return exitStartupFailed
+	}
+
+	err = common.LoadStopWords(stopWordsPath)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if rankingProfilesPath != "" {
+		err = loadRankingProfiles(rankingProfilesPath)
+		if err != nil {
+			fmt.Println("loading ranking profiles:", err)
+			return exitStartupFailed
+		}
+	}
+
+	topics, err := parseTopics(*topicsPath)
+	if err != nil {
+		fmt.Println("reading topics:", err)
+		return exitStartupFailed
+	}
+
+	configs := []evalConfig{{Label: "A", Generation: *generation, Profile: *profile}}
+	if *compareProfile != "" || *compareGeneration != "" {
+		second := evalConfig{Label: "B", Generation: *compareGeneration, Profile: *compareProfile}
+		if second.Profile == "" {
+			second.Profile = *profile
+		}
+		if second.Generation == "" {
+			second.Generation = *generation
+		}
+		configs = append(configs, second)
+	}
+
+	var qrels map[string]map[int]int
+	var summaries []evalSummary
+	for _, config := range configs {
+		gen, err := openEvalGeneration(config.Generation)
+		if err != nil {
+			fmt.Println("opening generation:", err)
+			return exitStartupFailed
+		}
+		if config.Generation == "" {
+			config.Generation = gen.name
+		}
+
+		// every generation indexes the same collection, so docIds agree
+		if qrels == nil {
+			qrels, err = parseQrels(context.Background(), *qrelsPath, gen)
+			if err != nil {
+				gen.close()
+				fmt.Println("reading qrels:", err)
+				return exitStartupFailed
+			}
+		}
+
+		summary, err := evaluate(gen, config, topics, qrels, *k, *depth)
+		gen.close()
+		if err != nil {
+			fmt.Println("evaluating:", err)
+			return exitStartupFailed
+		}
+		summaries = append(summaries, summary)
+	}
+
+	writeEvalReport(os.Stdout, summaries, *k)
+	return exitOk
+}
+
+func writeEvalReport(out io.Writer, summaries []evalSummary, k int) {
+	for _, summary := range summaries {
+		fmt.Fprintf(out, "%s: profile %s, generation %s\n", summary.Config.Label, summary.Config.Profile, summary.Config.Generation)
+	}
+	fmt.Fprintln(out)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+
+	metrics := []string{fmt.Sprintf("P@%d", k), "AP", "RR", fmt.Sprintf("nDCG@%d", k)}
+	values := func(scores topicScores) []float64 {
+		return []float64{scores.Precision, scores.AveragePrecision, scores.ReciprocalRank, scores.NDCG}
+	}
+
+	// one column per metric and configuration
+	header := "topic\trelevant\t"
+	for _, metric := range metrics {
+		for _, summary := range summaries {
+			header += metric + " " + summary.Config.Label + "\t"
+		}
+	}
+	fmt.Fprintln(w, header)
+
+	for i, topic := range summaries[0].Topics {
+		row := topic.Topic + "\t" + strconv.Itoa(topic.Relevant) + "\t"
+		for m := range metrics {
+			for _, summary := range summaries {
+				scores := summary.Topics[i]
+				if scores.Relevant == 0 {
+					row += "-\t"
+					continue
+				}
+				mark := ""
+				if scores.Failed != "" {
+					mark = "!"
+				} else if scores.Partial {
+					mark = "*"
+				}
+				row += fmt.Sprintf("%.4f%s\t", values(scores)[m], mark)
+			}
+		}
+		fmt.Fprintln(w, row)
+	}
+
+	means := func(summary evalSummary) []float64 {
+		return []float64{summary.MeanP, summary.MAP, summary.MRR, summary.MeanNDCG}
+	}
+	row := "mean\t" + strconv.Itoa(summaries[0].Judged) + "\t"
+	for m := range metrics {
+		for _, summary := range summaries {
+			row += fmt.Sprintf("%.4f\t", means(summary)[m])
+		}
+	}
+	fmt.Fprintln(w, row)
+	w.Flush()
+
+	for _, summary := range summaries {
+		if summary.Failed > 0 {
+			fmt.Fprintf(out, "%s: %d topics failed and were scored as finding nothing\n", summary.Config.Label, summary.Failed)
+		}
+	}
+
+	if len(summaries) < 2 {
+		return
+	}
+
+	a, b := summaries[0], summaries[1]
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	for m, metric := range metrics {
+		var better, worse int
+		for i := range a.Topics {
+			if a.Topics[i].Relevant == 0 {
+				continue
+			}
+			delta := values(b.Topics[i])[m] - values(a.Topics[i])[m]
+			if delta > 1e-9 {
+				better++
+			} else if delta < -1e-9 {
+				worse++
+			}
+		}
+		fmt.Fprintf(w, "%s\tB-A %+.4f\tB better on %d\tworse on %d\ttied on %d\t\n",
+			metricName(metric), means(b)[m]-means(a)[m], better, worse, a.Judged-better-worse)
+	}
+}
+
+// the name of a metric's mean
+func metricName(metric string) string {
+	switch metric {
+	case "AP":
+		return "MAP"
+	case "RR":
+		return "MRR"
+	}
+	return "mean " + metric
+}
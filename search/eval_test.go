@@ -0,0 +1,242 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScoreTopic(t *testing.T) {
+	tests := []struct {
+		name      string
+		ranked    []int
+		judgments map[int]int
+		k         int
+		want      topicScores
+	}{
+		{
+			name:      "no relevant documents",
+			ranked:    []int{1, 2},
+			judgments: map[int]int{1: 0},
+			k:         2,
+			want:      topicScores{},
+		},
+		{
+			name:      "binary judgments",
+			ranked:    []int{1, 2, 3, 4},
+			judgments: map[int]int{1: 1, 3: 1},
+			k:         2,
+			want: topicScores{
+				Relevant:         2,
+				Precision:        0.5,
+				AveragePrecision: (1 + 2.0/3) / 2,
+				ReciprocalRank:   1,
+				NDCG:             1 / (1 + 1/math.Log2(3)),
+			},
+		},
+		{
+			name:      "graded judgments out of order",
+			ranked:    []int{2, 1},
+			judgments: map[int]int{1: 2, 2: 1},
+			k:         2,
+			want: topicScores{
+				Relevant:         2,
+				Precision:        1,
+				AveragePrecision: 1,
+				ReciprocalRank:   1,
+				NDCG:             (1 + 3/math.Log2(3)) / (3 + 1/math.Log2(3)),
+			},
+		},
+		{
+			name:      "first relevant document below the cutoff",
+			ranked:    []int{5, 6, 1},
+			judgments: map[int]int{1: 1},
+			k:         2,
+			want: topicScores{
+				Relevant:         1,
+				AveragePrecision: 1.0 / 3,
+				ReciprocalRank:   1.0 / 3,
+			},
+		},
+		{
+			name:      "relevant documents not retrieved",
+			ranked:    []int{5, 6},
+			judgments: map[int]int{1: 2, 2: 1},
+			k:         2,
+			want:      topicScores{Relevant: 2},
+		},
+		{
+			name:      "nothing retrieved",
+			ranked:    nil,
+			judgments: map[int]int{1: 1},
+			k:         10,
+			want:      topicScores{Relevant: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := scoreTopic(test.ranked, test.judgments, test.k)
+			if got.Relevant != test.want.Relevant {
+				t.Errorf("Relevant = %d, want %d", got.Relevant, test.want.Relevant)
+			}
+
+			metrics := []struct {
+				name      string
+				got, want float64
+			}{
+				{"Precision", got.Precision, test.want.Precision},
+				{"AveragePrecision", got.AveragePrecision, test.want.AveragePrecision},
+				{"ReciprocalRank", got.ReciprocalRank, test.want.ReciprocalRank},
+				{"NDCG", got.NDCG, test.want.NDCG},
+			}
+			for _, metric := range metrics {
+				if math.Abs(metric.got-metric.want) > 1e-9 {
+					t.Errorf("%s = %v, want %v", metric.name, metric.got, metric.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGain(t *testing.T) {
+	tests := []struct {
+		relevance int
+		i         int
+		want      float64
+	}{
+		{0, 0, 0},
+		{1, 0, 1},
+		{2, 0, 3},
+		{3, 2, 3.5},
+		{1, 1, 1 / math.Log2(3)},
+	}
+
+	for _, test := range tests {
+		got := gain(test.relevance, test.i)
+		if math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("gain(%d, %d) = %v, want %v", test.relevance, test.i, got, test.want)
+		}
+	}
+}
+
+func TestReadTopics(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []evalTopic
+		wantErr bool
+	}{
+		{
+			name: "trec topics",
+			content: `<top>
+<num> Number: 401
+<title> Topic: wireless
+  networks
+<desc> Description:
+Documents about wireless networks.
+</top>
+<top>
+<num>402</num>
+<title>potato farming</title>
+</top>`,
+			want: []evalTopic{{"401", "wireless networks"}, {"402", "potato farming"}},
+		},
+		{
+			name:    "lines",
+			content: "# id query\n1 network protocols\n\n2\tpotato  farming\n",
+			want:    []evalTopic{{"1", "network protocols"}, {"2", "potato  farming"}},
+		},
+		{
+			name:    "trec topic without a title",
+			content: "<top><num> 401 </top>",
+			wantErr: true,
+		},
+		{
+			name:    "line without a query",
+			content: "1 network\n2\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readTopics([]byte(test.content))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("readTopics() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readTopics() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readTopics() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadQrels(t *testing.T) {
+	urls := map[string]int{"https://a.org/x": 5}
+	lookup := func(url string) (int, error) {
+		docId, ok := urls[url]
+		if !ok {
+			return 0, errDocumentNotFound
+		}
+		return docId, nil
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]map[int]int
+		wantErr bool
+	}{
+		{
+			name:    "docIds and urls",
+			content: "401 0 12 1\n\n401 0 https://a.org/x 2\n402 0 7 0\n",
+			want:    map[string]map[int]int{"401": {12: 1, 5: 2}, "402": {7: 0}},
+		},
+		{
+			name:    "later judgment wins",
+			content: "401 0 12 1\n401 0 12 3\n",
+			want:    map[string]map[int]int{"401": {12: 3}},
+		},
+		{
+			name:    "missing field",
+			content: "401 0 12\n",
+			wantErr: true,
+		},
+		{
+			name:    "relevance not an integer",
+			content: "401 0 12 high\n",
+			wantErr: true,
+		},
+		{
+			name:    "url outside the collection",
+			content: "401 0 https://b.org/y 1\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readQrels(strings.NewReader(test.content), "qrels.txt", lookup)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("readQrels() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readQrels() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("readQrels() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// per-term contribution to a document's cosine similarity
+type termExplanation struct {
+	Term              string  `json:"term"`
+	Idf               float64 `json:"idf"`
+	QueryWeight       float64 `json:"queryWeight"`
+	DocumentFrequency int     `json:"documentFrequency"`
+	DocumentTf        float64 `json:"documentTf"`
+	FieldBoost        float64 `json:"fieldBoost"`
+	DocumentWeight    float64 `json:"documentWeight"`
+	Product           float64 `json:"product"`
+}
+
+// breakdown of the score search assigns to a single document
+type scoreExplanation struct {
+	DocId              int               `json:"docId"`
+	DocUrl             string            `json:"docUrl"`
+	Matched            bool              `json:"matched"`
+	Profile            string            `json:"profile"`
+	Scorer             string            `json:"scorer"`
+	Normalization      string            `json:"normalization"`
+	Terms              []termExplanation `json:"terms"`
+	QueryLength        float64           `json:"queryLength"`
+	DocumentLength     float64           `json:"documentLength"`
+	Numerator          float64           `json:"numerator"`
+	CosineSimilarity   float64           `json:"cosineSimilarity"`
+	CosineWeight       float64           `json:"cosineWeight"`
+	CosinePart         float64           `json:"cosinePart"`
+	PageRank           float64           `json:"pagerank"`
+	NormalizedPageRank float64           `json:"normalizedPagerank"`
+	PageRankWeight     float64           `json:"pagerankWeight"`
+	PageRankPart       float64           `json:"pagerankPart"`
+	ClickRatio         float64           `json:"clickRatio"` // clicks over the clicks expected at the positions shown, 0 without data
+	ClickWeight        float64           `json:"clickWeight"`
+	ClickBoost         float64           `json:"clickBoost"`
+	Score              float64           `json:"score"`
+}
+
+// explain repeats the arithmetic search performs for one document and
+// records every intermediate value. A document that does not match the
+// query is never scored by search, so Matched is false and the score shown
+// is what it would have received.
+func explain(ctx context.Context, gen *indexGeneration, query searchQuery, docId int) (scoreExplanation, error) {
+	idb, cdb, dictionary := gen.idb, gen.cdb, gen.dictionary
+	ranking := query.Ranking
+
+	explanation := scoreExplanation{
+		DocId:          docId,
+		Profile:        ranking.Name,
+		Scorer:         ranking.Scorer,
+		Normalization:  ranking.Normalization,
+		CosineWeight:   ranking.CosineWeight,
+		PageRankWeight: ranking.PagerankWeight,
+		ClickWeight:    ranking.ClickWeight,
+		Terms:          []termExplanation{},
+	}
+
+	// get query term weights and length
+	queryTermToWeight, queryLength := processQuery(query.Terms, dictionary)
+	explanation.QueryLength = queryLength
+
+	itx, err := idb.BeginTx(ctx, nil)
+	if err != nil {
+		return explanation, searchContextError(ctx, err)
+	}
+	defer itx.Rollback()
+
+	// excluded terms are only needed to decide whether the document matches
+	var allTerms = make(map[string]bool)
+	query.Match.terms(allTerms)
+	var termToPostingList = make(map[string]map[int]int)
+	for term := range allTerms {
+		_, inDictionary := dictionary[term]
+		if inDictionary {
+			postingList, err := getPostingList(ctx, itx, term)
+			if err != nil {
+				return explanation, searchContextError(ctx, err)
+			}
+
+			termToPostingList[term] = postingList
+		}
+	}
+	explanation.Matched = query.Match.matches(docId, termToPostingList)
+	if query.Filters.hasFieldFilters() {
+		if gen.fields == nil {
+			return explanation, errFieldsUnavailable
+		}
+		explanation.Matched = explanation.Matched && query.Filters.allows(gen.fields[docId])
+	}
+
+	// terms of the title and url, for profiles that boost them
+	var fieldTerms map[string]map[string]bool
+	if len(ranking.FieldBoosts) > 0 {
+		fieldTerms, err = getDocumentFieldTerms(ctx, cdb, docId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return explanation, errDocumentNotFound
+		} else if err != nil {
+			return explanation, searchContextError(ctx, err)
+		}
+	}
+
+	// walk the query terms in the same order search sums them
+	sortedQueryTerms := sortTermsByIdf(queryTermToWeight, dictionary)
+	for _, term := range sortedQueryTerms {
+		termExplanation := termExplanation{
+			Term:        term,
+			Idf:         dictionary[term],
+			QueryWeight: queryTermToWeight[term],
+		}
+
+		docFrequency, hasDoc := termToPostingList[term][docId]
+		if hasDoc {
+			termExplanation.DocumentFrequency = docFrequency
+			termExplanation.DocumentTf = logTermFrequency(docFrequency)
+			termExplanation.FieldBoost = ranking.fieldBoost(term, fieldTerms)
+			termExplanation.DocumentWeight = termExplanation.DocumentTf * dictionary[term] * termExplanation.FieldBoost
+			termExplanation.Product = termExplanation.DocumentWeight * termExplanation.QueryWeight
+
+			explanation.Numerator += termExplanation.Product
+		}
+
+		explanation.Terms = append(explanation.Terms, termExplanation)
+	}
+
+	// fetch document length
+	explanation.DocumentLength, err = getDocumentLength(ctx, itx, docId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return explanation, errDocumentNotFound
+	} else if err != nil {
+		return explanation, searchContextError(ctx, err)
+	}
+
+	if err := itx.Commit(); err != nil {
+		return explanation, err
+	}
+
+	colTx, err := cdb.BeginTx(ctx, nil)
+	if err != nil {
+		return explanation, searchContextError(ctx, err)
+	}
+	defer colTx.Rollback()
+
+	// fetch document pagerank score and url
+	explanation.PageRank, err = getDocumentPagerank(ctx, colTx, docId)
+	if err != nil {
+		return explanation, searchContextError(ctx, err)
+	}
+
+	row := colTx.QueryRowContext(ctx, "SELECT url FROM docIdToData WHERE docId = ?", docId)
+	err = row.Scan(&explanation.DocUrl)
+	if err != nil {
+		return explanation, searchContextError(ctx, err)
+	}
+
+	if err := colTx.Commit(); err != nil {
+		return explanation, err
+	}
+
+	explanation.CosineSimilarity = ranking.similarity(explanation.Numerator, explanation.DocumentLength, queryLength)
+	explanation.NormalizedPageRank = ranking.normalizePagerank(explanation.PageRank, gen.maxPagerank)
+	explanation.CosinePart = explanation.CosineSimilarity * ranking.CosineWeight
+	explanation.PageRankPart = explanation.NormalizedPageRank * ranking.PagerankWeight
+	explanation.ClickRatio = clickBoosts.forQuery(query.Text)[docId]
+	explanation.ClickBoost = ranking.clickBoost(explanation.ClickRatio)
+	explanation.Score = blendScore(explanation.CosineSimilarity, explanation.NormalizedPageRank, ranking.CosineWeight, ranking.PagerankWeight) * explanation.ClickBoost
+
+	return explanation, nil
+}
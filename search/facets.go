@@ -0,0 +1,83 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// document attributes a search can count its matches by
+var facetFields = map[string]func(documentFields) string{
+	"host":        func(document documentFields) string { return document.Host },
+	"language":    func(document documentFields) string { return document.Language },
+	"contentType": func(document documentFields) string { return document.ContentType },
+}
+
+// most values returned per facet, the rest are only counted in Other
+var maxFacetValues = 10
+
+type facetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// counts of one facet, largest first
+type facetResult struct {
+	Values []facetCount `json:"values"`
+	Other  int          `json:"other"` // matches with values past the cut off
+}
+
+// checks requested facet names, dropping repeats
+func parseFacets(names []string) ([]string, error) {
+	var facets []string
+	for _, name := range names {
+		_, known := facetFields[name]
+		if !known {
+			return nil, invalidRequest("unknown facet %q, facets are host, language and contentType", name)
+		}
+
+		if !slices.Contains(facets, name) {
+			facets = append(facets, name)
+		}
+	}
+
+	return facets, nil
+}
+
+// counts every matched document by each facet
+func countFacets(fields map[int]documentFields, docIds []int, facets []string) map[string]facetResult {
+	results := make(map[string]facetResult)
+
+	for _, facet := range facets {
+		valueOf := facetFields[facet]
+		counts := make(map[string]int)
+		for _, docId := range docIds {
+			value := valueOf(fields[docId])
+			if value == "" {
+				value = "unknown"
+			}
+			counts[value]++
+		}
+
+		var values []facetCount
+		for value, count := range counts {
+			values = append(values, facetCount{Value: value, Count: count})
+		}
+		slices.SortFunc(values, func(a, b facetCount) int {
+			if a.Count != b.Count {
+				return b.Count - a.Count
+			}
+			return strings.Compare(a.Value, b.Value)
+		})
+
+		result := facetResult{Values: values}
+		if len(values) > maxFacetValues {
+			result.Values = values[:maxFacetValues]
+			for _, value := range values[maxFacetValues:] {
+				result.Other += value.Count
+			}
+		}
+		results[facet] = result
+	}
+
+	return results
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/KevinBasta/yam-search/common"
+)
+
+// per document fields the indexer stores for filtering
+type documentFields struct {
+	Host        string
+	Url         string
+	Language    string
+	ContentType string
+}
+
+// loads the fields of every document, nil when the generation was built
+// before the indexer stored them
+func loadDocumentFields(idb *sql.DB) (map[int]documentFields, error) {
+	var tables int
+	err := idb.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'docIdToFields'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return nil, err
+	}
+
+	rows, err := idb.Query("SELECT docId, host, url, language, contentType FROM docIdToFields")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := make(map[int]documentFields)
+	for rows.Next() {
+		var docId int
+		var document documentFields
+		err := rows.Scan(&docId, &document.Host, &document.Url, &document.Language, &document.ContentType)
+		if err != nil {
+			return nil, err
+		}
+
+		fields[docId] = document
+	}
+
+	return fields, rows.Err()
+}
+
+// whether host is site or one of its subdomains
+func hostMatches(host string, site string) bool {
+	return host == site || strings.HasSuffix(host, "."+site)
+}
+
+func (f searchFilters) hasFieldFilters() bool {
+	return len(f.Sites) > 0 || len(f.ExcludeSites) > 0 || len(f.InUrl) > 0 || len(f.ExcludeInUrl) > 0
+}
+
+// whether a document passes the site and url filters. A document must be on
+// one of the sites when any are given, and its url must contain every inurl
+// value and none of the excluded ones.
+func (f searchFilters) allows(document documentFields) bool {
+	for _, site := range f.ExcludeSites {
+		if hostMatches(document.Host, site) {
+			return false
+		}
+	}
+
+	if len(f.Sites) > 0 {
+		onSite := false
+		for _, site := range f.Sites {
+			onSite = onSite || hostMatches(document.Host, site)
+		}
+		if !onSite {
+			return false
+		}
+	}
+
+	url := strings.ToLower(document.Url)
+	for _, part := range f.InUrl {
+		if !strings.Contains(url, part) {
+			return false
+		}
+	}
+	for _, part := range f.ExcludeInUrl {
+		if strings.Contains(url, part) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// adds one site or inurl filter, values are normalized the way the indexer
+// stores hosts so they compare equal
+func (f *searchFilters) add(operator string, value string, excluded bool) {
+	switch operator {
+	case "site":
+		site := common.NormalizeHost(value)
+		if excluded {
+			f.ExcludeSites = append(f.ExcludeSites, site)
+		} else {
+			f.Sites = append(f.Sites, site)
+		}
+	case "inurl":
+		part := strings.ToLower(value)
+		if excluded {
+			f.ExcludeInUrl = append(f.ExcludeInUrl, part)
+		} else {
+			f.InUrl = append(f.InUrl, part)
+		}
+	}
+}
+
+// splits a query word such as -site:example.org into its operator and
+// value, ok is false for ordinary words
+func queryOperator(word string) (operator string, value string, excluded bool, ok bool) {
+	excluded = strings.HasPrefix(word, "-")
+	word = strings.TrimPrefix(word, "-")
+
+	for _, operator := range []string{"site", "inurl"} {
+		value, found := strings.CutPrefix(word, operator+":")
+		if found && value != "" {
+			return operator, value, excluded, true
+		}
+	}
+
+	return "", "", false, false
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KevinBasta/yam-search/common"
+)
+
+// directory the indexer writes generations and their markers into
+var outDir string = "../out"
+
+// one loaded copy of the index. Queries hold a reference for as long as
+// they run, so a replaced generation is only closed once they finish.
+type indexGeneration struct {
+	id          int64
+	name        string
+	loadedAt    time.Time
+	idb         *sql.DB
+	cdb         *sql.DB
+	dictionary  map[string]float64 // term -> idf (inverse document frequency)
+	totalDocs   int
+	maxPagerank float64
+	fields      map[int]documentFields // nil for generations indexed without fields
+	termVectors bool                   // whether document term vectors were kept
+	suggestions *suggestionTrie        // nil for generations indexed without unstemmed words
+	refs        atomic.Int64
+}
+
+var generationMu sync.RWMutex
+var currentGeneration *indexGeneration
+var generationCount atomic.Int64
+
+// serializes reloads so the watcher and admin endpoint never load twice
+var reloadMu sync.Mutex
+
+// why the last reload failed, cleared by a successful one
+var lastReloadError error
+
+// returns the generation queries should run against, the caller must
+// release it when done
+func acquireGeneration() (*indexGeneration, error) {
+	generationMu.RLock()
+	defer generationMu.RUnlock()
+
+	gen := currentGeneration
+	if gen == nil || len(gen.dictionary) == 0 {
+		return nil, errIndexUnavailable
+	}
+
+	gen.refs.Add(1)
+	return gen, nil
+}
+
+func (gen *indexGeneration) release() {
+	if gen.refs.Add(-1) == 0 {
+		gen.close()
+	}
+}
+
+func (gen *indexGeneration) close() {
+	fmt.Println("closing index generation", gen.id, gen.name)
+	closeDatabase("index", gen.idb)
+	closeDatabase("collection", gen.cdb)
+}
+
+// makes gen current, the previous generation is closed once the last
+// query using it releases it
+func swapGeneration(gen *indexGeneration) {
+	// the current slot holds a reference of its own
+	gen.refs.Add(1)
+
+	generationMu.Lock()
+	old := currentGeneration
+	currentGeneration = gen
+	generationMu.Unlock()
+
+	fmt.Println("serving index generation", gen.id, gen.name)
+	if old != nil {
+		old.release()
+	}
+}
+
+// drops the current generation at shutdown
+func retireGeneration() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	generationMu.Lock()
+	old := currentGeneration
+	currentGeneration = nil
+	generationMu.Unlock()
+
+	if old != nil {
+		old.release()
+	}
+}
+
+// name of the generation the indexer last finished, empty when the out
+// directory predates generations
+func readGenerationMarker() (string, error) {
+	return common.ReadMarker(outDir, common.GenerationMarker)
+}
+
+// opens the databases and dictionary of the named generation, an empty
+// name loads the index files directly inside the out directory
+func openGeneration(name string) (*indexGeneration, error) {
+	dir := outDir
+	if name != "" {
+		dir = filepath.Join(outDir, common.GenerationsDir, name)
+	}
+
+	gen := &indexGeneration{
+		name:     name,
+		loadedAt: time.Now(),
+	}
+
+	// sqlite would create missing files as empty databases
+	dictionaryDB := filepath.Join(dir, "dictionary.db")
+	indexDB := filepath.Join(dir, "index.db")
+	for _, path := range []string{dictionaryDB, indexDB, collectionDB} {
+		_, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	gen.dictionary, err = loadDictionary(dictionaryDB)
+	if err != nil {
+		return nil, err
+	}
+
+	gen.suggestions, err = loadSuggestions(dictionaryDB)
+	if err != nil {
+		return nil, err
+	}
+
+	gen.idb, err = sql.Open("sqlite", indexDB)
+	if err != nil {
+		return nil, err
+	}
+
+	gen.totalDocs, err = loadTotalDocs(gen.idb)
+	if err != nil {
+		gen.idb.Close()
+		return nil, err
+	}
+
+	gen.cdb, err = sql.Open("sqlite", collectionDB)
+	if err != nil {
+		gen.idb.Close()
+		return nil, err
+	}
+
+	gen.fields, err = loadDocumentFields(gen.idb)
+	if err != nil {
+		gen.close()
+		return nil, err
+	}
+
+	gen.termVectors, err = hasTermVectors(gen)
+	if err != nil {
+		gen.close()
+		return nil, err
+	}
+
+	gen.maxPagerank, err = loadMaxPagerank(gen.cdb)
+	if err != nil {
+		gen.close()
+		return nil, err
+	}
+
+	err = checkGeneration(gen)
+	if err != nil {
+		gen.close()
+		return nil, err
+	}
+
+	gen.id = generationCount.Add(1)
+	return gen, nil
+}
+
+// refuses generations that could only serve empty or inconsistent results
+func checkGeneration(gen *indexGeneration) error {
+	if len(gen.dictionary) == 0 {
+		return errors.New("dictionary is empty")
+	}
+
+	if gen.totalDocs <= 0 {
+		return errors.New("index metadata reports no documents")
+	}
+
+	var postingLists int
+	err := gen.idb.QueryRow("SELECT COUNT(*) FROM termToPostingList").Scan(&postingLists)
+	if err != nil {
+		return err
+	}
+	if postingLists != len(gen.dictionary) {
+		return fmt.Errorf("dictionary has %d terms but the index has %d posting lists", len(gen.dictionary), postingLists)
+	}
+
+	var maxDocId sql.NullInt64
+	err = gen.cdb.QueryRow("SELECT MAX(docId) FROM docIdToData").Scan(&maxDocId)
+	if err != nil {
+		return err
+	}
+	if maxDocId.Int64 < int64(gen.totalDocs) {
+		return fmt.Errorf("index has %d documents but the collection only has %d", gen.totalDocs, maxDocId.Int64)
+	}
+
+	return nil
+}
+
+// loads the generation named by the marker and swaps it in, a failed load
+// leaves the current generation serving. With onlyIfChanged nothing is
+// loaded while the marker still names the current generation.
+func reloadGeneration(onlyIfChanged bool) (*indexGeneration, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	name, err := readGenerationMarker()
+	if err != nil {
+		return nil, err
+	}
+
+	generationMu.RLock()
+	current := currentGeneration
+	generationMu.RUnlock()
+	if onlyIfChanged && current != nil && current.name == name {
+		return current, nil
+	}
+
+	gen, err := openGeneration(name)
+	if err != nil {
+		lastReloadError = err
+		return nil, err
+	}
+	lastReloadError = nil
+
+	swapGeneration(gen)
+
+	// tells the indexer not to remove the generation while it is served
+	if name != "" {
+		err := common.WriteMarker(outDir, common.ServedGenerationMarker, name)
+		if err != nil {
+			fmt.Println("writing served generation marker:", err)
+		}
+	}
+
+	return gen, nil
+}
+
+// polls the generation marker and reloads when the indexer publishes a new
+// generation, until stop is closed
+func watchGenerationMarker(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		_, err := reloadGeneration(true)
+		if err != nil {
+			fmt.Println("reloading index generation failed:", err)
+		}
+	}
+}
@@ -4,8 +4,11 @@ go 1.24.6
 
 require (
 	github.com/KevinBasta/yam-search/common v0.0.0
+	github.com/blevesearch/snowballstem v0.9.0
 	modernc.org/sqlite v1.40.1
-	github.com/blevesearch/snowballstem v0.9.0 // indirect
+)
+
+require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/KevinBasta/yam-search/common"
+)
+
+// how long readiness waits on each database ping
+var readinessPingTimeout = time.Second
+
+type healthResponse struct {
+	Status string `json:"status"`
+}
+
+type readinessResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// reports that the process is up, regardless of index state
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, healthResponse{Status: "ok"})
+}
+
+// reports ready only while stop words are loaded and a consistent
+// generation with reachable databases is being served
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	response := readinessResponse{Ready: true, Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			response.Ready = false
+			response.Checks[name] = err.Error()
+		} else {
+			response.Checks[name] = "ok"
+		}
+	}
+
+	if len(common.StopWords) == 0 {
+		check("stopwords", fmt.Errorf("no stop words loaded"))
+	} else {
+		check("stopwords", nil)
+	}
+
+	gen, err := acquireGeneration()
+	if err != nil {
+		reloadMu.Lock()
+		if lastReloadError != nil {
+			err = fmt.Errorf("%w: %v", err, lastReloadError)
+		}
+		reloadMu.Unlock()
+
+		check("generation", err)
+	} else {
+		defer gen.release()
+
+		// the dictionary and metadata were checked when the generation loaded
+		check("generation", nil)
+		check("dictionary", nil)
+		check("metadata", nil)
+
+		ctx, cancel := context.WithTimeout(r.Context(), readinessPingTimeout)
+		defer cancel()
+		check("indexDB", gen.idb.PingContext(ctx))
+		check("collectionDB", gen.cdb.PingContext(ctx))
+	}
+
+	status := http.StatusOK
+	if !response.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSONStatus(w, r, status, response)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cumulative histogram in the prometheus sense, bucket i counts every
+// observation less than or equal to its upper bound
+type histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// latency buckets in seconds, from a lookup in pages sqlite already
+// holds to a query near the default time budget
+var latencyBounds = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	separator := ""
+	if labels != "" {
+		separator = ","
+	}
+
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, separator, formatFloat(bound), h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, separator, h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, wrapLabels(labels), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, wrapLabels(labels), h.count)
+}
+
+// counter split by a set of label values
+type labeledCounter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newLabeledCounter() *labeledCounter {
+	return &labeledCounter{counts: make(map[string]uint64)}
+}
+
+func (c *labeledCounter) inc(labels string) {
+	c.mu.Lock()
+	c.counts[labels]++
+	c.mu.Unlock()
+}
+
+func (c *labeledCounter) write(w io.Writer, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	labelSets := make([]string, 0, len(c.counts))
+	for labels := range c.counts {
+		labelSets = append(labelSets, labels)
+	}
+	slices.Sort(labelSets)
+
+	for _, labels := range labelSets {
+		fmt.Fprintf(w, "%s%s %d\n", name, wrapLabels(labels), c.counts[labels])
+	}
+}
+
+// query stages timed by search
+const (
+	stageAnalysis        = "analysis"
+	stagePostingFetch    = "posting_fetch"
+	stageScoring         = "scoring"
+	stageDiversification = "diversification"
+	stageResultAssembly  = "result_assembly"
+)
+
+var queryStages = []string{stageAnalysis, stagePostingFetch, stageScoring, stageDiversification, stageResultAssembly}
+
+var queryDuration = newHistogram(latencyBounds)
+var queryStageDuration = map[string]*histogram{
+	stageAnalysis:        newHistogram(latencyBounds),
+	stagePostingFetch:    newHistogram(latencyBounds),
+	stageScoring:         newHistogram(latencyBounds),
+	stageDiversification: newHistogram(latencyBounds),
+	stageResultAssembly:  newHistogram(latencyBounds),
+}
+var partialSearches atomic.Uint64
+var httpRequests = newLabeledCounter()
+
+// time spent in each stage of one search
+type searchTimings map[string]time.Duration
+
+func observeSearch(total time.Duration, results searchResults) {
+	queryDuration.observe(total)
+	for stage, duration := range results.Timings {
+		queryStageDuration[stage].observe(duration)
+	}
+
+	if results.Partial {
+		partialSearches.Add(1)
+	}
+}
+
+// remembers the status a handler wrote so it can be counted
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// counts responses by route and status code
+func withMetrics(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		httpRequests.inc(fmt.Sprintf("route=%q,code=\"%d\"", route, recorder.status))
+	})
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeHeader(w, "yam_http_requests_total", "counter", "HTTP responses by route and status code.")
+	httpRequests.write(w, "yam_http_requests_total")
+
+	writeHeader(w, "yam_query_duration_seconds", "histogram", "End to end search latency.")
+	queryDuration.write(w, "yam_query_duration_seconds", "")
+
+	writeHeader(w, "yam_query_stage_duration_seconds", "histogram", "Search latency by stage.")
+	for _, stage := range queryStages {
+		queryStageDuration[stage].write(w, "yam_query_stage_duration_seconds", fmt.Sprintf("stage=%q", stage))
+	}
+
+	writeHeader(w, "yam_query_partial_total", "counter", "Searches that ran out of time budget and returned partial results.")
+	fmt.Fprintf(w, "yam_query_partial_total %d\n", partialSearches.Load())
+
+	writeHeader(w, "yam_query_log_dropped_total", "counter", "Query log records dropped because the writer fell behind.")
+	fmt.Fprintf(w, "yam_query_log_dropped_total %d\n", queryLogger.droppedCount())
+
+	gen, err := acquireGeneration()
+	if err != nil {
+		// index stats are only reported while a generation is loaded
+		return
+	}
+	defer gen.release()
+
+	writeHeader(w, "yam_index_generation", "gauge", "Id of the index generation being served.")
+	fmt.Fprintf(w, "yam_index_generation{name=%q} %d\n", gen.name, gen.id)
+	writeHeader(w, "yam_index_generation_loaded_timestamp_seconds", "gauge", "When the served generation was loaded.")
+	fmt.Fprintf(w, "yam_index_generation_loaded_timestamp_seconds %d\n", gen.loadedAt.Unix())
+	writeHeader(w, "yam_index_documents", "gauge", "Documents in the served generation.")
+	fmt.Fprintf(w, "yam_index_documents %d\n", gen.totalDocs)
+	writeHeader(w, "yam_index_terms", "gauge", "Terms in the dictionary of the served generation.")
+	fmt.Fprintf(w, "yam_index_terms %d\n", len(gen.dictionary))
+
+	writeDBStats(w, gen)
+}
+
+func writeDBStats(w io.Writer, gen *indexGeneration) {
+	databases := []struct {
+		name  string
+		stats sql.DBStats
+	}{
+		{"index", gen.idb.Stats()},
+		{"collection", gen.cdb.Stats()},
+	}
+
+	writeHeader(w, "yam_sqlite_open_connections", "gauge", "Open connections by database.")
+	for _, db := range databases {
+		fmt.Fprintf(w, "yam_sqlite_open_connections{db=%q} %d\n", db.name, db.stats.OpenConnections)
+	}
+	writeHeader(w, "yam_sqlite_in_use_connections", "gauge", "Connections in use by database.")
+	for _, db := range databases {
+		fmt.Fprintf(w, "yam_sqlite_in_use_connections{db=%q} %d\n", db.name, db.stats.InUse)
+	}
+	writeHeader(w, "yam_sqlite_idle_connections", "gauge", "Idle connections by database.")
+	for _, db := range databases {
+		fmt.Fprintf(w, "yam_sqlite_idle_connections{db=%q} %d\n", db.name, db.stats.Idle)
+	}
+	writeHeader(w, "yam_sqlite_wait_count_total", "counter", "Times a query waited for a connection.")
+	for _, db := range databases {
+		fmt.Fprintf(w, "yam_sqlite_wait_count_total{db=%q} %d\n", db.name, db.stats.WaitCount)
+	}
+	writeHeader(w, "yam_sqlite_wait_duration_seconds_total", "counter", "Time spent waiting for a connection.")
+	for _, db := range databases {
+		fmt.Fprintf(w, "yam_sqlite_wait_duration_seconds_total{db=%q} %s\n", db.name, formatFloat(db.stats.WaitDuration.Seconds()))
+	}
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+
+	return "{" + labels + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
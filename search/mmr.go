@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"math"
+)
+
+// maximal marginal relevance re-ranking of the top of the results
+type diversifyOptions struct {
+	Lambda float64 // 1 ranks by relevance alone, 0 by novelty alone
+	Depth  int     // how many top results are re-ranked, 0 disables
+}
+
+var defaultDiversifyDepth = 50
+var maxDiversifyDepth = 200
+
+func checkDiversify(options diversifyOptions) error {
+	if options.Lambda < 0 || options.Lambda > 1 {
+		return invalidRequest("lambda must be between 0 and 1")
+	}
+
+	if options.Depth < 0 || options.Depth > maxDiversifyDepth {
+		return invalidRequest("diversify depth must be between 1 and %d", maxDiversifyDepth)
+	}
+
+	return nil
+}
+
+// re-orders the first Depth ranked documents, each time picking the one
+// that maximises
+//
+//	lambda * relevance - (1 - lambda) * highest similarity to those picked
+//
+// where relevance is the score relative to the best score, so both parts
+// range over 0 to 1. Documents past Depth keep their order.
+func diversify(ctx context.Context, tx sqlQuerier, rankedDocIds []int, docIdToScore map[int]float64, dictionary map[string]float64, options diversifyOptions) ([]int, error) {
+	depth := min(options.Depth, len(rankedDocIds))
+	if depth < 2 {
+		return rankedDocIds, nil
+	}
+
+	candidates := rankedDocIds[:depth]
+	vectors := make(map[int]map[string]float64, depth)
+	for _, docId := range candidates {
+		vector, err := getTermVector(ctx, tx, docId, dictionary)
+		if err != nil {
+			return nil, err
+		}
+		vectors[docId] = vector
+	}
+
+	// candidates may be sorted by something other than score, such as pagerank
+	bestScore := 0.0
+	for _, docId := range candidates {
+		bestScore = math.Max(bestScore, docIdToScore[docId])
+	}
+	relevance := func(docId int) float64 {
+		if bestScore <= 0 {
+			return 0
+		}
+		return docIdToScore[docId] / bestScore
+	}
+
+	// highest similarity of each remaining candidate to the picked documents
+	maxSimilarity := make(map[int]float64, depth)
+	remaining := append([]int(nil), candidates...)
+	picked := make([]int, 0, len(rankedDocIds))
+
+	for len(remaining) > 0 {
+		bestIndex, bestValue := 0, math.Inf(-1)
+		for i, docId := range remaining {
+			value := options.Lambda*relevance(docId) - (1-options.Lambda)*maxSimilarity[docId]
+			// remaining keeps rank order, so ties go to the higher ranked
+			if value > bestValue {
+				bestIndex, bestValue = i, value
+			}
+		}
+
+		chosen := remaining[bestIndex]
+		picked = append(picked, chosen)
+		remaining = append(remaining[:bestIndex], remaining[bestIndex+1:]...)
+
+		for _, docId := range remaining {
+			maxSimilarity[docId] = max(maxSimilarity[docId], vectorSimilarity(vectors[chosen], vectors[docId]))
+		}
+	}
+
+	return append(picked, rankedDocIds[depth:]...), nil
+}
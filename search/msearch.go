@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// most queries one batch may hold, and how many of them run at once. Each
+// query takes a rate limit token, so the default fits in the default burst.
+var maxBatchQueries = 20
+var batchConcurrency = 4
+
+// body of POST /msearch, each query has the schema of a POST /search body
+type multiSearchRequest struct {
+	Queries []json.RawMessage `json:"queries"`
+}
+
+// outcome of one query in a batch, either its results or its error
+type multiSearchItem struct {
+	Status  int                    `json:"status"`
+	Results []searchResult         `json:"results,omitempty"`
+	Total   int                    `json:"total"`
+	Partial bool                   `json:"partial,omitempty"`
+	Facets  map[string]facetResult `json:"facets,omitempty"`
+	Hidden  int                    `json:"hidden,omitempty"`
+	Error   *apiError              `json:"error,omitempty"`
+}
+
+type multiSearchResponse struct {
+	Responses []multiSearchItem `json:"responses"`
+}
+
+// decodes one query of a batch the way POST /search decodes its body
+func decodeBatchQuery(raw json.RawMessage, allowOverrides bool) (searchQuery, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+
+	var body searchRequestBody
+	err := decoder.Decode(&body)
+	if err != nil {
+		return searchQuery{}, invalidRequest("query is not valid: %v", err)
+	}
+
+	return compileSearchBody(body, defaultSearchQuery(), allowOverrides)
+}
+
+// runs every query of the batch against one generation under the deadline of
+// ctx. A failing query only fails its own item, the order of items matches
+// the order of queries.
+func multiSearch(ctx context.Context, gen *indexGeneration, queries []json.RawMessage, allowOverrides bool, client string) []multiSearchItem {
+	items := make([]multiSearchItem, len(queries))
+	slots := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+
+	for i, raw := range queries {
+		query, err := decodeBatchQuery(raw, allowOverrides)
+		if err != nil {
+			items[i] = batchError(err)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			start := time.Now()
+			results, err := search(ctx, gen, query)
+			latency := time.Since(start)
+			logQuery(client, "/msearch", query, results, latency, err)
+			if err != nil {
+				items[i] = batchError(err)
+				return
+			}
+			observeSearch(latency, results)
+
+			items[i] = multiSearchItem{
+				Status:  http.StatusOK,
+				Results: results.Results,
+				Total:   results.Total,
+				Partial: results.Partial,
+				Facets:  results.Facets,
+				Hidden:  results.Hidden,
+			}
+		}()
+	}
+
+	wg.Wait()
+	return items
+}
+
+// the item reported for a failed query, errors that are not apiErrors are
+// logged and reported as internal errors
+func batchError(err error) multiSearchItem {
+	if errors.Is(err, context.Canceled) {
+		return multiSearchItem{Status: errSearchTimeout.Status, Error: errSearchTimeout}
+	}
+
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		fmt.Println("batch query failed:", err)
+		apiErr = errInternal
+	}
+
+	return multiSearchItem{Status: apiErr.Status, Error: apiErr}
+}
+
+// POST a batch of queries, answered with one item per query
+func multiSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, errMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+
+	var request multiSearchRequest
+	err := decoder.Decode(&request)
+	if err != nil {
+		writeError(w, r, invalidRequest("body is not a valid batch: %v", err))
+		return
+	}
+	if len(request.Queries) == 0 || len(request.Queries) > maxBatchQueries {
+		writeError(w, r, invalidRequest("queries must hold between 1 and %d queries", maxBatchQueries))
+		return
+	}
+
+	// every query of the batch costs as much as a request of its own
+	if !rateLimitRequest(w, r, len(request.Queries)) || !chargeQuota(w, r, len(request.Queries)) {
+		return
+	}
+
+	gen, err := acquireGeneration()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer gen.release()
+
+	// the whole batch shares one time budget
+	ctx, cancel, err := searchContext(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer cancel()
+
+	items := multiSearch(ctx, gen, request.Queries, canOverrideRanking(r), clientId(r))
+
+	// nobody is left to read the response of a cancelled batch
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		writeError(w, r, r.Context().Err())
+		return
+	}
+
+	writeJSON(w, r, multiSearchResponse{Responses: items})
+	fmt.Println("served batch of", len(items), "queries")
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/KevinBasta/yam-search/common"
+)
+
+// node of the boolean tree deciding which documents match a query
+type queryNode struct {
+	Op       string // "and", "or", "not" or "term"
+	Term     string // analyzed term of a "term" node
+	Children []*queryNode
+}
+
+// a positive query term and how much it counts towards the query vector
+type queryTerm struct {
+	Frequency int
+	Boost     float64
+}
+
+// compiled form of a query. The GET parameters and the POST body both
+// compile to one, so search never sees where a query came from.
+type searchQuery struct {
+	Text      string               // original text, for logs and spelling suggestions
+	Match     *queryNode           // documents qualify when this evaluates true
+	Terms     map[string]queryTerm // terms outside any "not", these are scored
+	Filters   searchFilters
+	Sort      string
+	Offset    int
+	Limit     int
+	Ranking   rankingProfile
+	Highlight highlightOptions
+	Facets    []string // attributes to count matches by
+	Collapse  collapseOptions
+	Diversify diversifyOptions
+}
+
+type searchFilters struct {
+	MinPagerank   float64
+	Sites         []string // hosts a document must be on one of, subdomains included
+	ExcludeSites  []string
+	InUrl         []string // lowercased parts every url must contain
+	ExcludeInUrl  []string
+	ExcludeDocIds []int // documents never returned, such as the source of a more-like-this query
+}
+
+type highlightOptions struct {
+	Snippet bool // include a snippet with each result
+	Words   int  // snippet length in words
+	Markup  bool // wrap matched words in <mark>, html escaping the rest
+}
+
+// ways results can be ordered
+const (
+	sortRelevance = "relevance"
+	sortPagerank  = "pagerank"
+)
+
+var defaultHighlight = highlightOptions{Snippet: true, Words: snippetWords, Markup: false}
+
+// whether docId satisfies the tree, given the posting lists of its terms
+func (n *queryNode) matches(docId int, termToPostingList map[string]map[int]int) bool {
+	switch n.Op {
+	case "term":
+		_, hasDoc := termToPostingList[n.Term][docId]
+		return hasDoc
+	case "and":
+		for _, child := range n.Children {
+			if !child.matches(docId, termToPostingList) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, child := range n.Children {
+			if child.matches(docId, termToPostingList) {
+				return true
+			}
+		}
+		return false
+	case "not":
+		return !n.Children[0].matches(docId, termToPostingList)
+	}
+
+	return false
+}
+
+// every distinct term in the tree, including excluded ones
+func (n *queryNode) terms(into map[string]bool) {
+	if n.Op == "term" {
+		into[n.Term] = true
+	}
+
+	for _, child := range n.Children {
+		child.terms(into)
+	}
+}
+
+// parses the text of a GET query into query. Words match documents
+// containing any of them, a word starting with + must be in every match and
+// one starting with - must not be in any. site: and inurl: words, optionally
+// prefixed with -, become filters.
+func compileQueryText(query *searchQuery) error {
+	terms := make(map[string]queryTerm)
+	var required, excluded, optional []*queryNode
+
+	for _, word := range strings.Fields(query.Text) {
+		operator, value, excludedValue, isOperator := queryOperator(word)
+		if isOperator {
+			query.Filters.add(operator, value, excludedValue)
+			continue
+		}
+
+		prefix := word[0]
+		if prefix == '+' || prefix == '-' {
+			word = word[1:]
+		}
+
+		// format, drop stop words and stem
+		term, ok := common.AnalyzeWord(word)
+		if !ok {
+			continue
+		}
+		node := &queryNode{Op: "term", Term: term}
+
+		switch prefix {
+		case '-':
+			excluded = append(excluded, &queryNode{Op: "not", Children: []*queryNode{node}})
+			continue
+		case '+':
+			required = append(required, node)
+		default:
+			optional = append(optional, node)
+		}
+
+		terms[term] = queryTerm{Frequency: terms[term].Frequency + 1, Boost: 1}
+	}
+
+	// nothing left to search for once stop words are removed
+	if len(terms) == 0 {
+		return errNoQueryTerms
+	}
+
+	// optional words only add to the score once some words are required
+	match := &queryNode{Op: "or", Children: optional}
+	if len(required) > 0 {
+		match = &queryNode{Op: "and", Children: required}
+	}
+	if len(excluded) > 0 {
+		match = &queryNode{Op: "and", Children: append([]*queryNode{match}, excluded...)}
+	}
+
+	query.Match, query.Terms = match, terms
+	return checkQueryCost(match)
+}
+
+// every term costs a posting list fetch and a pass over its documents
+func checkQueryCost(match *queryNode) error {
+	allTerms := make(map[string]bool)
+	match.terms(allTerms)
+	if len(allTerms) > maxQueryTerms {
+		return errTooManyTerms
+	}
+
+	return nil
+}
+
+// body of POST /search
+//
+//	{
+//	  "query":     node, required
+//	  "filters":   {"minPagerank": number, "sites": [host, ...], "excludeSites": [host, ...],
+//	                "inurl": [string, ...], "excludeInurl": [string, ...]},
+//	  "sort":      "relevance" (default) or "pagerank",
+//	  "offset":    integer >= 0, default 0,
+//	  "limit":     integer 1-100, default 10,
+//	  "profile":   name of a ranking profile, default "default",
+//	  "ranking":   {"cosineWeight": number, "pagerankWeight": number,
+//	                "scorer": "cosine" or "tfidf", "normalization": "none" or "max",
+//	                "fieldBoosts": {"title": number, "url": number}, "clickWeight": number},
+//	  "highlight": {"snippet": bool, "words": integer 1-200, "markup": bool},
+//	  "facets":    ["host", "language", "contentType"],
+//	  "collapse":  {"field": "host" or "prefix", "perGroup": integer 1-100, default 2},
+//	  "diversify": {"lambda": number 0-1, "depth": integer 1-200, default 50}
+//	}
+//
+// where a node has exactly one of
+//
+//	{"text": "free text"}          matches documents with any of its terms
+//	{"term": "word", "boost": n}   matches documents with the term, boost scales its query weight
+//	{"and": [node, ...]}           matches documents matching every child
+//	{"or": [node, ...]}            matches documents matching any child
+//	{"not": node}                  matches documents not matching the child
+//
+// Every term outside a "not" is scored. At least one must exist, and unknown
+// fields are rejected. Only documents containing a scored term are searched,
+// so a "not" may only be a child of an "and" that also has another kind of
+// child, and a document is never matched through a "not" alone. Values in ranking override the chosen profile and are
+// only accepted from callers allowed to override ranking.
+type searchRequestBody struct {
+	Query     *queryNodeBody `json:"query"`
+	Filters   *filtersBody   `json:"filters"`
+	Sort      string         `json:"sort"`
+	Offset    *int           `json:"offset"`
+	Limit     *int           `json:"limit"`
+	Profile   string         `json:"profile"`
+	Ranking   *rankingBody   `json:"ranking"`
+	Highlight *highlightBody `json:"highlight"`
+	Facets    []string       `json:"facets"`
+	Collapse  *collapseBody  `json:"collapse"`
+	Diversify *diversifyBody `json:"diversify"`
+}
+
+type diversifyBody struct {
+	Lambda *float64 `json:"lambda"`
+	Depth  *int     `json:"depth"`
+}
+
+type collapseBody struct {
+	Field    string `json:"field"`
+	PerGroup *int   `json:"perGroup"`
+}
+
+type queryNodeBody struct {
+	Text  *string          `json:"text"`
+	Term  *string          `json:"term"`
+	Boost *float64         `json:"boost"`
+	And   []*queryNodeBody `json:"and"`
+	Or    []*queryNodeBody `json:"or"`
+	Not   *queryNodeBody   `json:"not"`
+}
+
+type filtersBody struct {
+	MinPagerank  *float64 `json:"minPagerank"`
+	Sites        []string `json:"sites"`
+	ExcludeSites []string `json:"excludeSites"`
+	InUrl        []string `json:"inurl"`
+	ExcludeInUrl []string `json:"excludeInurl"`
+}
+
+type rankingBody struct {
+	CosineWeight   *float64           `json:"cosineWeight"`
+	PagerankWeight *float64           `json:"pagerankWeight"`
+	Scorer         *string            `json:"scorer"`
+	Normalization  *string            `json:"normalization"`
+	FieldBoosts    map[string]float64 `json:"fieldBoosts"`
+	ClickWeight    *float64           `json:"clickWeight"`
+}
+
+type highlightBody struct {
+	Snippet *bool `json:"snippet"`
+	Words   *int  `json:"words"`
+	Markup  *bool `json:"markup"`
+}
+
+// deepest a query tree may nest
+var maxQueryDepth = 8
+
+func invalidRequest(format string, args ...any) *apiError {
+	return &apiError{400, "invalid_request", fmt.Sprintf(format, args...)}
+}
+
+// validates body and compiles it onto base, which carries the defaults
+func compileSearchBody(body searchRequestBody, base searchQuery, allowOverrides bool) (searchQuery, error) {
+	query := base
+
+	if body.Query == nil {
+		return query, invalidRequest("query is required")
+	}
+
+	query.Terms = make(map[string]queryTerm)
+	var texts []string
+	match, err := compileNode(body.Query, "query", 1, false, query.Terms, &texts)
+	if err != nil {
+		return query, err
+	}
+	if len(query.Terms) == 0 {
+		return query, invalidRequest("query needs at least one searchable term outside a not")
+	}
+	if match.Op == "not" {
+		return query, invalidRequest("query is a not, which is only allowed directly in an and")
+	}
+	query.Match = match
+	query.Text = strings.Join(texts, " ")
+
+	err = checkQueryCost(match)
+	if err != nil {
+		return query, err
+	}
+
+	if body.Filters != nil {
+		if body.Filters.MinPagerank != nil {
+			query.Filters.MinPagerank = *body.Filters.MinPagerank
+		}
+
+		values := []struct {
+			field    string
+			operator string
+			excluded bool
+			values   []string
+		}{
+			{"sites", "site", false, body.Filters.Sites},
+			{"excludeSites", "site", true, body.Filters.ExcludeSites},
+			{"inurl", "inurl", false, body.Filters.InUrl},
+			{"excludeInurl", "inurl", true, body.Filters.ExcludeInUrl},
+		}
+		for _, filter := range values {
+			for _, value := range filter.values {
+				if strings.TrimSpace(value) == "" {
+					return query, invalidRequest("filters.%s must not contain empty values", filter.field)
+				}
+				query.Filters.add(filter.operator, value, filter.excluded)
+			}
+		}
+	}
+
+	switch body.Sort {
+	case "":
+	case sortRelevance, sortPagerank:
+		query.Sort = body.Sort
+	default:
+		return query, invalidRequest("sort must be %q or %q", sortRelevance, sortPagerank)
+	}
+
+	if body.Offset != nil {
+		if *body.Offset < 0 {
+			return query, invalidRequest("offset must not be negative")
+		}
+		query.Offset = *body.Offset
+	}
+
+	if body.Limit != nil {
+		if *body.Limit < 1 || *body.Limit > maxLimit {
+			return query, invalidRequest("limit must be between 1 and %d", maxLimit)
+		}
+		query.Limit = *body.Limit
+	}
+
+	if body.Profile != "" {
+		query.Ranking, err = lookupProfile(body.Profile)
+		if err != nil {
+			return query, err
+		}
+	}
+
+	if body.Ranking != nil {
+		if !allowOverrides {
+			return query, errRankingOverride
+		}
+
+		// the profile keeps its name, overrides only change its values
+		ranking := query.Ranking
+		if body.Ranking.CosineWeight != nil {
+			ranking.CosineWeight = *body.Ranking.CosineWeight
+		}
+		if body.Ranking.PagerankWeight != nil {
+			ranking.PagerankWeight = *body.Ranking.PagerankWeight
+		}
+		if body.Ranking.Scorer != nil {
+			ranking.Scorer = *body.Ranking.Scorer
+		}
+		if body.Ranking.Normalization != nil {
+			ranking.Normalization = *body.Ranking.Normalization
+		}
+		if body.Ranking.FieldBoosts != nil {
+			ranking.FieldBoosts = body.Ranking.FieldBoosts
+		}
+		if body.Ranking.ClickWeight != nil {
+			ranking.ClickWeight = *body.Ranking.ClickWeight
+		}
+
+		err = checkProfile(ranking)
+		if err != nil {
+			return query, err
+		}
+		query.Ranking = ranking
+	}
+
+	query.Facets, err = parseFacets(body.Facets)
+	if err != nil {
+		return query, err
+	}
+
+	if body.Collapse != nil {
+		if body.Collapse.Field == "" {
+			return query, invalidRequest("collapse.field is required")
+		}
+		query.Collapse.Field = body.Collapse.Field
+		if body.Collapse.PerGroup != nil {
+			query.Collapse.PerGroup = *body.Collapse.PerGroup
+		}
+
+		err = checkCollapse(query.Collapse)
+		if err != nil {
+			return query, err
+		}
+	}
+
+	if body.Diversify != nil {
+		if body.Diversify.Lambda == nil {
+			return query, invalidRequest("diversify.lambda is required")
+		}
+		query.Diversify = diversifyOptions{Lambda: *body.Diversify.Lambda, Depth: defaultDiversifyDepth}
+		if body.Diversify.Depth != nil {
+			if *body.Diversify.Depth < 1 {
+				return query, invalidRequest("diversify depth must be between 1 and %d", maxDiversifyDepth)
+			}
+			query.Diversify.Depth = *body.Diversify.Depth
+		}
+
+		err = checkDiversify(query.Diversify)
+		if err != nil {
+			return query, err
+		}
+	}
+
+	if body.Highlight != nil {
+		if body.Highlight.Snippet != nil {
+			query.Highlight.Snippet = *body.Highlight.Snippet
+		}
+		if body.Highlight.Words != nil {
+			if *body.Highlight.Words < 1 || *body.Highlight.Words > 200 {
+				return query, invalidRequest("highlight.words must be between 1 and 200")
+			}
+			query.Highlight.Words = *body.Highlight.Words
+		}
+		if body.Highlight.Markup != nil {
+			query.Highlight.Markup = *body.Highlight.Markup
+		}
+	}
+
+	return query, nil
+}
+
+// compiles one node of the body, recording scored terms unless the node is
+// under a "not"
+func compileNode(body *queryNodeBody, path string, depth int, negated bool, terms map[string]queryTerm, texts *[]string) (*queryNode, error) {
+	if body == nil {
+		return nil, invalidRequest("%s must be an object", path)
+	}
+
+	if depth > maxQueryDepth {
+		return nil, invalidRequest("%s nests deeper than %d levels", path, maxQueryDepth)
+	}
+
+	set := 0
+	for _, present := range []bool{body.Text != nil, body.Term != nil, body.And != nil, body.Or != nil, body.Not != nil} {
+		if present {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, invalidRequest("%s must have exactly one of text, term, and, or, not", path)
+	}
+
+	if body.Boost != nil && body.Term == nil {
+		return nil, invalidRequest("%s.boost is only allowed on term nodes", path)
+	}
+
+	boost := 1.0
+	if body.Boost != nil {
+		boost = *body.Boost
+		if boost <= 0 {
+			return nil, invalidRequest("%s.boost must be positive", path)
+		}
+	}
+
+	addTerm := func(term string) *queryNode {
+		if !negated {
+			existing := terms[term]
+			terms[term] = queryTerm{Frequency: existing.Frequency + 1, Boost: max(existing.Boost, boost)}
+		}
+		return &queryNode{Op: "term", Term: term}
+	}
+
+	switch {
+	case body.Text != nil:
+		node := &queryNode{Op: "or"}
+		for _, word := range strings.Fields(*body.Text) {
+			term, ok := common.AnalyzeWord(word)
+			if ok {
+				node.Children = append(node.Children, addTerm(term))
+			}
+		}
+		if len(node.Children) == 0 {
+			return nil, invalidRequest("%s.text contains no searchable terms", path)
+		}
+		if !negated {
+			*texts = append(*texts, *body.Text)
+		}
+		return node, nil
+
+	case body.Term != nil:
+		if len(strings.Fields(*body.Term)) != 1 {
+			return nil, invalidRequest("%s.term must be a single word, use text for several", path)
+		}
+		term, ok := common.AnalyzeWord(*body.Term)
+		if !ok {
+			return nil, invalidRequest("%s.term is a stop word or has no letters", path)
+		}
+		if !negated {
+			*texts = append(*texts, *body.Term)
+		}
+		return addTerm(term), nil
+
+	case body.And != nil || body.Or != nil:
+		op, children := "and", body.And
+		if body.Or != nil {
+			op, children = "or", body.Or
+		}
+		if len(children) == 0 {
+			return nil, invalidRequest("%s.%s must not be empty", path, op)
+		}
+
+		node := &queryNode{Op: op}
+		positive := false
+		for i, child := range children {
+			childPath := fmt.Sprintf("%s.%s[%d]", path, op, i)
+			compiled, err := compileNode(child, childPath, depth+1, negated, terms, texts)
+			if err != nil {
+				return nil, err
+			}
+			if compiled.Op == "not" && op != "and" {
+				return nil, invalidRequest("%s is a not, which is only allowed directly in an and", childPath)
+			}
+			positive = positive || compiled.Op != "not"
+			node.Children = append(node.Children, compiled)
+		}
+		if !positive {
+			return nil, invalidRequest("%s.and needs a child that is not a not", path)
+		}
+		return node, nil
+
+	default:
+		compiled, err := compileNode(body.Not, path+".not", depth+1, !negated, terms, texts)
+		if err != nil {
+			return nil, err
+		}
+		if compiled.Op == "not" {
+			return nil, invalidRequest("%s.not is a not, which is only allowed directly in an and", path)
+		}
+		return &queryNode{Op: "not", Children: []*queryNode{compiled}}, nil
+	}
+}
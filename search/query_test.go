@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/KevinBasta/yam-search/common"
+)
+
+func TestCompileSearchBodyErrors(t *testing.T) {
+	common.StopWords["the"] = 0
+	defer delete(common.StopWords, "the")
+
+	// a text node under nine levels of and
+	deep := `{"text": "network"}`
+	for range maxQueryDepth {
+		deep = `{"and": [` + deep + `]}`
+	}
+
+	var manyWords []string
+	for i := range maxQueryTerms + 1 {
+		manyWords = append(manyWords, fmt.Sprintf("x%c%c", 'a'+i/26, 'a'+i%26))
+	}
+
+	tests := []struct {
+		name           string
+		body           string
+		allowOverrides bool
+		want           error
+		wantMessage    string
+	}{
+		{"missing query", `{}`, false, nil, "query is required"},
+		{"empty node", `{"query": {}}`, false, nil, "query must have exactly one of text, term, and, or, not"},
+		{"two kinds in one node", `{"query": {"text": "network", "term": "cable"}}`, false, nil, "query must have exactly one of text, term, and, or, not"},
+		{"null child", `{"query": {"or": [{"text": "network"}, null]}}`, false, nil, "query.or[1] must be an object"},
+		{"empty and", `{"query": {"and": []}}`, false, nil, "query.and must not be empty"},
+		{"empty or in and", `{"query": {"and": [{"text": "network"}, {"or": []}]}}`, false, nil, "query.and[1].or must not be empty"},
+		{"too deep", `{"query": ` + deep + `}`, false, nil, "nests deeper than 8 levels"},
+		{"boost on text", `{"query": {"text": "network", "boost": 2}}`, false, nil, "query.boost is only allowed on term nodes"},
+		{"zero boost", `{"query": {"term": "network", "boost": 0}}`, false, nil, "query.boost must be positive"},
+		{"negative boost", `{"query": {"or": [{"term": "network", "boost": -1}]}}`, false, nil, "query.or[0].boost must be positive"},
+		{"several words in term", `{"query": {"term": "wireless network"}}`, false, nil, "query.term must be a single word, use text for several"},
+		{"stop word term", `{"query": {"term": "the"}}`, false, nil, "query.term is a stop word or has no letters"},
+		{"text without terms", `{"query": {"and": [{"text": "network"}, {"text": "the"}]}}`, false, nil, "query.and[1].text contains no searchable terms"},
+		{"only excluded terms", `{"query": {"not": {"text": "network"}}}`, false, nil, "query needs at least one searchable term outside a not"},
+		{"not under or", `{"query": {"or": [{"term": "network"}, {"not": {"term": "cable"}}]}}`, false, nil, "query.or[1] is a not, which is only allowed directly in an and"},
+		{"and of nots", `{"query": {"and": [{"term": "network"}, {"or": [{"term": "cable"}, {"and": [{"not": {"term": "switch"}}]}]}]}}`, false, nil, "query.and[1].or[1].and needs a child that is not a not"},
+		{"double not", `{"query": {"and": [{"term": "network"}, {"not": {"not": {"term": "cable"}}}]}}`, false, nil, "query.and[1].not is a not, which is only allowed directly in an and"},
+		{"top level double not", `{"query": {"not": {"and": [{"term": "network"}, {"not": {"term": "cable"}}]}}}`, false, nil, "query is a not, which is only allowed directly in an and"},
+		{"too many terms", `{"query": {"text": "` + strings.Join(manyWords, " ") + `"}}`, false, errTooManyTerms, ""},
+		{"empty site filter", `{"query": {"text": "network"}, "filters": {"sites": [" "]}}`, false, nil, "filters.sites must not contain empty values"},
+		{"empty inurl exclusion", `{"query": {"text": "network"}, "filters": {"excludeInurl": [""]}}`, false, nil, "filters.excludeInurl must not contain empty values"},
+		{"unknown sort", `{"query": {"text": "network"}, "sort": "date"}`, false, nil, `sort must be "relevance" or "pagerank"`},
+		{"negative offset", `{"query": {"text": "network"}, "offset": -1}`, false, nil, "offset must not be negative"},
+		{"zero limit", `{"query": {"text": "network"}, "limit": 0}`, false, nil, "limit must be between 1 and 100"},
+		{"limit too large", `{"query": {"text": "network"}, "limit": 101}`, false, nil, "limit must be between 1 and 100"},
+		{"ranking without overrides", `{"query": {"text": "network"}, "ranking": {"cosineWeight": 1}}`, false, errRankingOverride, ""},
+		{"collapse without field", `{"query": {"text": "network"}, "collapse": {}}`, false, nil, "collapse.field is required"},
+		{"diversify without lambda", `{"query": {"text": "network"}, "diversify": {"depth": 10}}`, false, nil, "diversify.lambda is required"},
+		{"zero diversify depth", `{"query": {"text": "network"}, "diversify": {"lambda": 0.5, "depth": 0}}`, false, nil, "diversify depth must be between 1 and 200"},
+		{"zero highlight words", `{"query": {"text": "network"}, "highlight": {"words": 0}}`, false, nil, "highlight.words must be between 1 and 200"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body searchRequestBody
+			err := json.Unmarshal([]byte(test.body), &body)
+			if err != nil {
+				t.Fatalf("decoding body: %v", err)
+			}
+
+			_, err = compileSearchBody(body, defaultSearchQuery(), test.allowOverrides)
+			if err == nil {
+				t.Fatal("compileSearchBody() succeeded, want an error")
+			}
+
+			if test.want != nil {
+				if !errors.Is(err, test.want) {
+					t.Errorf("compileSearchBody() error = %v, want %v", err, test.want)
+				}
+				return
+			}
+
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) || apiErr.Code != "invalid_request" {
+				t.Fatalf("compileSearchBody() error = %v, want an invalid_request error", err)
+			}
+			if !strings.Contains(apiErr.Message, test.wantMessage) {
+				t.Errorf("compileSearchBody() message = %q, want %q", apiErr.Message, test.wantMessage)
+			}
+		})
+	}
+}
+
+func TestCompileSearchBody(t *testing.T) {
+	body := searchRequestBody{}
+	err := json.Unmarshal([]byte(`{
+		"query": {"and": [{"term": "networks", "boost": 2}, {"text": "wireless networks"}, {"not": {"text": "cable"}}]},
+		"limit": 5
+	}`), &body)
+	if err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+
+	query, err := compileSearchBody(body, defaultSearchQuery(), false)
+	if err != nil {
+		t.Fatalf("compileSearchBody() error: %v", err)
+	}
+
+	if query.Text != "networks wireless networks" {
+		t.Errorf("Text = %q, want the scored words", query.Text)
+	}
+	if query.Limit != 5 {
+		t.Errorf("Limit = %d, want 5", query.Limit)
+	}
+
+	want := map[string]queryTerm{
+		"network":  {Frequency: 2, Boost: 2},
+		"wireless": {Frequency: 1, Boost: 1},
+	}
+	if len(query.Terms) != len(want) {
+		t.Errorf("Terms = %v, want %v", query.Terms, want)
+	}
+	for term, wantTerm := range want {
+		if query.Terms[term] != wantTerm {
+			t.Errorf("Terms[%q] = %+v, want %+v", term, query.Terms[term], wantTerm)
+		}
+	}
+}
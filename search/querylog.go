@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// file queries are appended to, the log is off when it is empty. Once a
+// log file passes the max size it is renamed with the time it was rotated
+// and the newest rotated files are kept.
+var queryLogPath string = "../out/queries.log"
+var logMaxSize int64 = 64 << 20
+var logKeep int = 5
+
+// records waiting to be written before new ones are dropped
+var logBuffer = 1024
+
+// layout of the time suffix of rotated files, it sorts by time
+const logRotateLayout = "20060102-150405.000"
+
+// status logged for queries the client gave up on, the one nginx uses
+const statusClientClosedRequest = 499
+
+// one query, answered or failed
+type queryLogRecord struct {
+	Time      time.Time `json:"time"`
+	Route     string    `json:"route"`
+	Query     string    `json:"query"`
+	Terms     []string  `json:"terms"` // analyzed terms the query scored
+	Hits      int       `json:"hits"`
+	LatencyMs float64   `json:"latencyMs"`
+	Offset    int       `json:"offset,omitempty"`
+	TopDocIds []int     `json:"topDocIds"` // the page returned, best first
+	Client    string    `json:"client"`
+	Partial   bool      `json:"partial,omitempty"`
+	Status    int       `json:"status"`          // http status, missing from records of older servers
+	Error     string    `json:"error,omitempty"` // error code of a failed query
+}
+
+func (record queryLogRecord) failed() bool {
+	return record.Status != 0 && record.Status != http.StatusOK
+}
+
+// appends json records from a single goroutine so requests never wait on
+// disk. Handlers still running after shutdown may append once the log is
+// closed, their records are dropped.
+type appendLog struct {
+	path    string
+	file    *os.File
+	size    int64
+	records chan any
+	done    chan struct{}
+	mu      sync.RWMutex // held to send on records, and to close it
+	closed  bool
+	dropped atomic.Uint64
+}
+
+var queryLogger *appendLog
+
+func openAppendLog(path string) (*appendLog, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &appendLog{
+		path:    path,
+		records: make(chan any, logBuffer),
+		done:    make(chan struct{}),
+	}
+
+	err = l.open()
+	if err != nil {
+		return nil, err
+	}
+
+	go l.run()
+	return l, nil
+}
+
+func (l *appendLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+func (l *appendLog) run() {
+	defer close(l.done)
+
+	for record := range l.records {
+		err := l.write(record)
+		if err != nil {
+			fmt.Println("writing", l.path+":", err)
+		}
+	}
+}
+
+func (l *appendLog) write(record any) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > logMaxSize {
+		err := l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// renames the full file out of the way and removes the oldest rotated files
+func (l *appendLog) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+
+	rotated := l.path + "." + time.Now().UTC().Format(logRotateLayout)
+	err = os.Rename(l.path, rotated)
+	if err != nil {
+		return err
+	}
+
+	err = l.open()
+	if err != nil {
+		return err
+	}
+
+	rotatedFiles, err := rotatedLogs(l.path)
+	if err != nil {
+		return err
+	}
+	for _, old := range rotatedFiles[:max(0, len(rotatedFiles)-logKeep)] {
+		err := os.Remove(old.path)
+		if err != nil {
+			fmt.Println("removing old log:", err)
+		}
+	}
+
+	return nil
+}
+
+// writes out the records still queued
+func (l *appendLog) close() {
+	l.mu.Lock()
+	l.closed = true
+	close(l.records)
+	l.mu.Unlock()
+	<-l.done
+
+	err := l.file.Close()
+	if err != nil {
+		fmt.Println("closing", l.path+":", err)
+	}
+}
+
+// queues record, dropping it when the writer has fallen too far behind
+func (l *appendLog) append(record any) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if l.closed {
+		l.dropped.Add(1)
+		return
+	}
+
+	select {
+	case l.records <- record:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// records dropped so far, 0 for a log that is off
+func (l *appendLog) droppedCount() uint64 {
+	if l == nil {
+		return 0
+	}
+
+	return l.dropped.Load()
+}
+
+// status and error code a failed query is logged with
+func queryLogStatus(err error) (int, string) {
+	if errors.Is(err, context.Canceled) {
+		return statusClientClosedRequest, "cancelled"
+	}
+
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		apiErr = errInternal
+	}
+
+	return apiErr.Status, apiErr.Code
+}
+
+// queues a record of a query, err is what the search failed with if it did
+func logQuery(client string, route string, query searchQuery, results searchResults, latency time.Duration, err error) {
+	if queryLogger == nil {
+		return
+	}
+
+	record := queryLogRecord{
+		Time:      time.Now().UTC(),
+		Route:     route,
+		Query:     query.Text,
+		Terms:     make([]string, 0, len(query.Terms)),
+		Hits:      results.Total,
+		LatencyMs: float64(latency.Microseconds()) / 1000,
+		Offset:    query.Offset,
+		TopDocIds: make([]int, 0, len(results.Results)),
+		Client:    client,
+		Partial:   results.Partial,
+		Status:    http.StatusOK,
+	}
+	if err != nil {
+		record.Status, record.Error = queryLogStatus(err)
+	}
+	for term := range query.Terms {
+		record.Terms = append(record.Terms, term)
+	}
+	sort.Strings(record.Terms)
+	for _, result := range results.Results {
+		record.TopDocIds = append(record.TopDocIds, result.DocId)
+	}
+
+	queryLogger.append(record)
+	if err != nil {
+		return
+	}
+
+	if results.Total > 0 {
+		pastQueries.add(query.Text)
+	}
+	clickBoosts.addImpressions(record)
+}
+
+type rotatedLog struct {
+	path      string
+	rotatedAt time.Time
+}
+
+// files rotated out of path, oldest first
+func rotatedLogs(path string) ([]rotatedLog, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var rotated []rotatedLog
+	for _, match := range matches {
+		rotatedAt, err := time.Parse(logRotateLayout, strings.TrimPrefix(match, path+"."))
+		if err != nil {
+			continue
+		}
+		rotated = append(rotated, rotatedLog{match, rotatedAt})
+	}
+
+	slices.SortFunc(rotated, func(a, b rotatedLog) int { return a.rotatedAt.Compare(b.rotatedAt) })
+	return rotated, nil
+}
+
+// calls fn with every query logged in [from, to), rotated files first. A
+// zero from or to leaves that end of the range open.
+func readQueryLog(path string, from time.Time, to time.Time, fn func(queryLogRecord)) error {
+	return readAppendLog(path, from, func(line []byte) {
+		var record queryLogRecord
+		err := json.Unmarshal(line, &record)
+		if err != nil {
+			// a crash can leave a torn last line
+			return
+		}
+
+		if inTimeRange(record.Time, from, to) {
+			fn(record)
+		}
+	})
+}
+
+func inTimeRange(t time.Time, from time.Time, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+// calls fn with every line of path and the files rotated out of it, oldest
+// first, skipping rotated files that only hold lines from before from
+func readAppendLog(path string, from time.Time, fn func([]byte)) error {
+	rotated, err := rotatedLogs(path)
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for _, file := range rotated {
+		// a rotated file only holds records from before it was rotated
+		if !from.IsZero() && file.rotatedAt.Before(from) {
+			continue
+		}
+		paths = append(paths, file.path)
+	}
+	paths = append(paths, path)
+
+	for _, path := range paths {
+		err := readAppendLogFile(path, fn)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readAppendLogFile(path string, fn func([]byte)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		fn(scanner.Bytes())
+	}
+
+	return scanner.Err()
+}
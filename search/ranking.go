@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/KevinBasta/yam-search/common"
+)
+
+// file of named ranking profiles, only the built in default exists when
+// it is empty
+var rankingProfilesPath string = ""
+
+// ways the text part of a score is computed
+const (
+	scorerCosine = "cosine" // dot product over both vector lengths
+	scorerTfIdf  = "tfidf"  // dot product over the query length only, long documents are not penalised
+)
+
+// ways pagerank is scaled before it is blended in
+const (
+	normalizeNone = "none"
+	normalizeMax  = "max" // divided by the largest pagerank in the collection
+)
+
+// fields whose terms can boost a matching document, the body is what the
+// index scores and always counts once
+var boostableFields = []string{"title", "url"}
+
+// how the score of a document is put together
+type rankingProfile struct {
+	Name           string             `json:"name"`
+	CosineWeight   float64            `json:"cosineWeight"`
+	PagerankWeight float64            `json:"pagerankWeight"`
+	Scorer         string             `json:"scorer"`
+	FieldBoosts    map[string]float64 `json:"fieldBoosts,omitempty"` // field -> multiplier for query terms also found in it
+	Normalization  string             `json:"normalization"`
+	ClickWeight    float64            `json:"clickWeight,omitempty"` // exponent of the click boost, 0 ignores clicks
+}
+
+type rankingProfileFile struct {
+	Profiles []rankingProfile `json:"profiles"`
+}
+
+var defaultProfileName = "default"
+
+// profiles by name, the default profile can be redefined in the file
+var rankingProfiles = map[string]rankingProfile{
+	defaultProfileName: {
+		Name:           defaultProfileName,
+		CosineWeight:   0.9,
+		PagerankWeight: 0.1,
+		Scorer:         scorerCosine,
+		Normalization:  normalizeNone,
+	},
+}
+
+// reads the profile file and adds its profiles to the built in default
+func loadRankingProfiles(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var file rankingProfileFile
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&file)
+	if err != nil {
+		return err
+	}
+
+	for _, profile := range file.Profiles {
+		if profile.Name == "" {
+			return fmt.Errorf("ranking profile without a name")
+		}
+
+		profile = withProfileDefaults(profile)
+		err := checkProfile(profile)
+		if err != nil {
+			return fmt.Errorf("ranking profile %s: %w", profile.Name, err)
+		}
+
+		rankingProfiles[profile.Name] = profile
+	}
+
+	return nil
+}
+
+func withProfileDefaults(profile rankingProfile) rankingProfile {
+	if profile.Scorer == "" {
+		profile.Scorer = scorerCosine
+	}
+	if profile.Normalization == "" {
+		profile.Normalization = normalizeNone
+	}
+
+	return profile
+}
+
+// reports what is wrong with a profile, messages name the offending field
+// so they can be returned to clients that override one
+func checkProfile(profile rankingProfile) error {
+	if profile.CosineWeight < 0 || profile.PagerankWeight < 0 || profile.ClickWeight < 0 {
+		return invalidRequest("ranking weights must not be negative")
+	}
+
+	if profile.Scorer != scorerCosine && profile.Scorer != scorerTfIdf {
+		return invalidRequest("ranking.scorer must be %q or %q", scorerCosine, scorerTfIdf)
+	}
+
+	if profile.Normalization != normalizeNone && profile.Normalization != normalizeMax {
+		return invalidRequest("ranking.normalization must be %q or %q", normalizeNone, normalizeMax)
+	}
+
+	for field, boost := range profile.FieldBoosts {
+		if field != "title" && field != "url" {
+			return invalidRequest("ranking.fieldBoosts only supports %s", strings.Join(boostableFields, " and "))
+		}
+		if boost <= 0 {
+			return invalidRequest("ranking.fieldBoosts.%s must be positive", field)
+		}
+	}
+
+	return nil
+}
+
+func lookupProfile(name string) (rankingProfile, error) {
+	if name == "" {
+		name = defaultProfileName
+	}
+
+	profile, ok := rankingProfiles[name]
+	if !ok {
+		return rankingProfile{}, errUnknownProfile
+	}
+
+	return profile, nil
+}
+
+// ad hoc ranking changes are for callers that authenticated with an api key,
+// or that run on the same machine with -trust-loopback when keys are off
+func canOverrideRanking(r *http.Request) bool {
+	if apiKeys != nil {
+		return apiKeyFrom(r.Context()) != nil
+	}
+
+	return trustLoopback && isLocalRequest(r)
+}
+
+// text part of a score for the profile's scorer
+func (profile rankingProfile) similarity(numerator float64, documentLength float64, queryLength float64) float64 {
+	if profile.Scorer == scorerTfIdf {
+		return calculateCosineSimilarity(numerator, 1, queryLength)
+	}
+
+	return calculateCosineSimilarity(numerator, documentLength, queryLength)
+}
+
+// pagerank scaled the way the profile asks
+func (profile rankingProfile) normalizePagerank(pagerank float64, maxPagerank float64) float64 {
+	if profile.Normalization == normalizeMax && maxPagerank > 0 {
+		return pagerank / maxPagerank
+	}
+
+	return pagerank
+}
+
+// factor a document's click boost scales its score by, 1 when the profile
+// ignores clicks or the document has no clicks or impressions for the query
+func (profile rankingProfile) clickBoost(boost float64) float64 {
+	if profile.ClickWeight == 0 || boost <= 0 {
+		return 1
+	}
+
+	return math.Pow(boost, profile.ClickWeight)
+}
+
+// largest boost among the fields containing term, 1 when none do
+func (profile rankingProfile) fieldBoost(term string, fieldTerms map[string]map[string]bool) float64 {
+	boost := 1.0
+	for field, fieldBoost := range profile.FieldBoosts {
+		if fieldTerms[field][term] {
+			boost = math.Max(boost, fieldBoost)
+		}
+	}
+
+	return boost
+}
+
+// analyzed terms of the title and url of a document, only looked up when
+// the profile boosts fields
+func getDocumentFieldTerms(ctx context.Context, tx sqlQuerier, docId int) (map[string]map[string]bool, error) {
+	var title, url string
+	row := tx.QueryRowContext(ctx, "SELECT title, url FROM docIdToData WHERE docId = ?", docId)
+	err := row.Scan(&title, &url)
+	if err != nil {
+		return nil, err
+	}
+
+	notWordRune := func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }
+	fieldTerms := map[string]map[string]bool{
+		"title": analyzeFieldTerms(strings.Fields(title)),
+		"url":   analyzeFieldTerms(strings.FieldsFunc(url, notWordRune)),
+	}
+
+	return fieldTerms, nil
+}
+
+func analyzeFieldTerms(words []string) map[string]bool {
+	terms := make(map[string]bool)
+	for _, word := range words {
+		term, ok := common.AnalyzeWord(word)
+		if ok {
+			terms[term] = true
+		}
+	}
+
+	return terms
+}
+
+// largest pagerank in the collection, for max normalization
+func loadMaxPagerank(cdb *sql.DB) (float64, error) {
+	var maxPagerank sql.NullFloat64
+	err := cdb.QueryRow("SELECT MAX(pagerank) FROM docIdToData").Scan(&maxPagerank)
+	if err != nil {
+		return 0, err
+	}
+
+	return maxPagerank.Float64, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sustained requests per second and burst allowed per client, a rate of
+// zero disables rate limiting for clients whose key sets no rate of its own
+var rateLimit float64 = 10
+var rateBurst float64 = 20
+
+// query cost limits, enforced on every search
+var maxQueryTerms int = 32
+var maxCandidates int = 10000
+
+type tokenBucket struct {
+	tokens  float64
+	rate    float64
+	burst   float64
+	updated time.Time
+}
+
+// token buckets keyed by client
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var limiter = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// takes cost tokens for client, when too few are left it returns how long
+// until enough will be
+func (l *rateLimiter) allow(client string, rate float64, burst float64, cost float64, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, updated: now}
+		l.buckets[client] = bucket
+	}
+
+	// refill for the time since the client was last seen
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.tokens = math.Min(burst, bucket.tokens+elapsed*rate)
+	bucket.rate, bucket.burst, bucket.updated = rate, burst, now
+
+	if bucket.tokens >= cost {
+		bucket.tokens -= cost
+		return true, 0
+	}
+
+	wait := (cost - bucket.tokens) / rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// drops buckets that have refilled completely, they behave the same as a
+// client that was never seen
+func (l *rateLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*bucket.rate >= bucket.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func pruneRateLimiter(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			limiter.prune(now)
+		}
+	}
+}
+
+// identifies the caller by the api key it authenticated with, otherwise by
+// address. Unchecked key headers are ignored, or a client could make up a
+// new bucket for every request.
+func clientId(r *http.Request) string {
+	key := apiKeyFrom(r.Context())
+	if key != nil {
+		return "key:" + key.Id
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// answers 429 with Retry-After once a client has used up its bucket
+func withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitRequest(w, r, 1) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// takes one token per query the request runs from the caller's bucket,
+// answering it with an error when there are not enough. Reports whether the
+// request may go on.
+func rateLimitRequest(w http.ResponseWriter, r *http.Request, queries int) bool {
+	// keys may carry their own limits
+	rate, burst := rateLimit, rateBurst
+	key := apiKeyFrom(r.Context())
+	if key != nil && key.Rate > 0 {
+		rate = key.Rate
+	}
+	if key != nil && key.Burst > 0 {
+		burst = key.Burst
+	}
+
+	if rate <= 0 {
+		return true
+	}
+	// a bucket smaller than one token would never let a request through
+	burst = math.Max(burst, 1)
+
+	// waiting would never help a request costing more than the bucket holds
+	if float64(queries) > burst {
+		writeError(w, r, invalidRequest("the request runs %d queries, more than the rate limit burst of %g", queries, burst))
+		return false
+	}
+
+	allowed, wait := limiter.allow(clientId(r), rate, burst, float64(queries), time.Now())
+	if !allowed {
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		writeError(w, r, errRateLimited)
+		return false
+	}
+
+	return true
+}
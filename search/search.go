@@ -1,24 +1,44 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"math"
+	"slices"
 	"sort"
 	"strings"
-
-	"github.com/KevinBasta/yam-search/common"
-	"github.com/blevesearch/snowballstem/english"
+	"time"
 )
 
 type searchResult struct {
-	DocUrl     string
-	Similarity float64
+	DocId       int
+	DocUrl      string
+	Title       string
+	Snippet     string
+	Similarity  float64
+	Group       string `json:",omitempty"` // collapse group, when collapsing
+	MoreInGroup int    `json:",omitempty"` // matches of the group collapsed away
+}
+
+// results per page unless a request asks otherwise, and the most it may ask for
+var defaultLimit = 10
+var maxLimit = 100
+
+// results of a search, partial when the time budget ran out while scoring
+type searchResults struct {
+	Results []searchResult
+	Total   int // documents scored
+	Partial bool
+	Facets  map[string]facetResult // counts over every scored document
+	Hidden  int                    // documents collapsed away
+	Timings searchTimings
 }
 
-func getPostingList(tx *sql.Tx, term string) (map[int]int, error) {
+func getPostingList(ctx context.Context, tx *sql.Tx, term string) (map[int]int, error) {
 	var jsonPostingList string
-	indexEntry := tx.QueryRow("SELECT postingList FROM termToPostingList WHERE term = ?", term)
+	indexEntry := tx.QueryRowContext(ctx, "SELECT postingList FROM termToPostingList WHERE term = ?", term)
 	indexErr := indexEntry.Scan(&jsonPostingList)
 	if indexErr != nil {
 		return nil, indexErr
@@ -33,9 +53,9 @@ func getPostingList(tx *sql.Tx, term string) (map[int]int, error) {
 	return postingList, nil
 }
 
-func getDocumentLength(tx *sql.Tx, docId int) (float64, error) {
+func getDocumentLength(ctx context.Context, tx sqlQuerier, docId int) (float64, error) {
 	var docLength float64
-	indexEntry := tx.QueryRow("SELECT length FROM docIdToLength WHERE docID = ?", docId)
+	indexEntry := tx.QueryRowContext(ctx, "SELECT length FROM docIdToLength WHERE docID = ?", docId)
 	indexErr := indexEntry.Scan(&docLength)
 	if indexErr != nil {
 		return 0.0, indexErr
@@ -44,9 +64,9 @@ func getDocumentLength(tx *sql.Tx, docId int) (float64, error) {
 	return docLength, nil
 }
 
-func getDocumentPagerank(tx *sql.Tx, docId int) (float64, error) {
+func getDocumentPagerank(ctx context.Context, tx *sql.Tx, docId int) (float64, error) {
 	var docPageRank float64
-	collectionEntry := cdb.QueryRow("SELECT pagerank FROM docIdToData WHERE docID = ?", docId)
+	collectionEntry := tx.QueryRowContext(ctx, "SELECT pagerank FROM docIdToData WHERE docID = ?", docId)
 	collectionErr := collectionEntry.Scan(&docPageRank)
 	if collectionErr != nil {
 		return 0.0, collectionErr
@@ -55,42 +75,85 @@ func getDocumentPagerank(tx *sql.Tx, docId int) (float64, error) {
 	return docPageRank, nil
 }
 
-// map: term -> (weight = idf * tf)
-func processQuery(query string) (map[string]float64, float64, error) {
-	var wordToFreqency = make(map[string]int)
-
-	// loop through words in the query
-	words := strings.Fields(query)
-	for _, word := range words {
-		// trim both ends of word of non number or letter characters
-		common.FormatWord(&word)
-		if word == "" {
-			continue
-		}
+// logarithmic term frequency shared by query and document weighting
+func logTermFrequency(frequency int) float64 {
+	if frequency <= 0 {
+		return 0
+	}
+
+	return float64(1) + math.Log10(float64(frequency))
+}
+
+// cosine similarity given the dot product and both vector lengths
+func calculateCosineSimilarity(numerator float64, documentLength float64, queryLength float64) float64 {
+	if documentLength > 0 && queryLength > 0 {
+		return numerator / (documentLength * queryLength)
+	}
+
+	return 0
+}
+
+// final ranking score from the cosine similarity and pagerank parts
+func blendScore(cosineSimilarity float64, pagerank float64, cosineWeight float64, pagerankWeight float64) float64 {
+	return (cosineSimilarity * cosineWeight) + (pagerank * pagerankWeight)
+}
+
+// query terms ordered from highest to lowest idf, which is the order
+// documents are discovered and dot products are summed in
+// docIds of a posting list, most occurrences of the term first and ties by
+// docId, so the documents scored before the candidate cap are the same best
+// ones on every call
+func candidateOrder(postingList map[int]int) []int {
+	docIds := make([]int, 0, len(postingList))
+	for docId := range postingList {
+		docIds = append(docIds, docId)
+	}
 
-		// skip this word if it's a stop word
-		_, isStopWord := common.StopWords[word]
-		if isStopWord {
-			continue
+	slices.SortFunc(docIds, func(a, b int) int {
+		if postingList[a] != postingList[b] {
+			return postingList[b] - postingList[a]
 		}
+		return a - b
+	})
 
-		// stem the word
-		common.SnowballEnv.SetCurrent(word)
-		english.Stem(common.SnowballEnv)
-		word = common.SnowballEnv.Current()
+	return docIds
+}
 
-		wordToFreqency[word]++
+func sortTermsByIdf(termToWeight map[string]float64, dictionary map[string]float64) []string {
+	var sortedTerms []string
+	for term := range termToWeight {
+		sortedTerms = append(sortedTerms, term)
 	}
 
-	// calculate weight for each term in query
-	var wordToWeight = make(map[string]float64)
-	for term, freq := range wordToFreqency {
-		var tf float64 = 0
-		if freq > 0 {
-			tf = float64(1) + math.Log10(float64(freq))
+	// switch to slices.SortFunc
+	sort.Slice(sortedTerms, func(i, j int) bool {
+		iIdf, hasI := dictionary[sortedTerms[i]]
+		if !hasI {
+			iIdf = 0
 		}
 
-		wordToWeight[term] = tf * dictionary[term] // tf * idf
+		jIdf, hasJ := dictionary[sortedTerms[j]]
+		if !hasJ {
+			jIdf = 0
+		}
+
+		// break ties by term so the summation order is stable between calls
+		if iIdf == jIdf {
+			return sortedTerms[i] < sortedTerms[j]
+		}
+
+		return iIdf > jIdf
+	})
+
+	return sortedTerms
+}
+
+// map: term -> (weight = idf * tf * boost)
+func processQuery(queryTerms map[string]queryTerm, dictionary map[string]float64) (map[string]float64, float64) {
+	// calculate weight for each term in query
+	var wordToWeight = make(map[string]float64)
+	for term, queryTerm := range queryTerms {
+		wordToWeight[term] = logTermFrequency(queryTerm.Frequency) * dictionary[term] * queryTerm.Boost
 	}
 
 	// calculate length of query for cosine similarity
@@ -100,88 +163,133 @@ func processQuery(query string) (map[string]float64, float64, error) {
 	}
 	length = math.Sqrt(length)
 
-	return wordToWeight, length, nil
+	return wordToWeight, length
 }
 
-func search(idb *sql.DB, cdb *sql.DB, query string, cosineWeight float64, pagerankWeight float64) ([]searchResult, error) {
+// search scores every document matching the query within the budget of ctx.
+// If the deadline passes or maxCandidates documents have been scored, the
+// documents scored so far are ranked and returned as partial results.
+// Candidates are scored in candidateOrder either way, so partial results
+// are always the front of the same list.
+func search(ctx context.Context, gen *indexGeneration, query searchQuery) (searchResults, error) {
+	idb, cdb, dictionary := gen.idb, gen.cdb, gen.dictionary
+	ranking := query.Ranking
+	timings := make(searchTimings)
+	stageStart := time.Now()
+
 	// get query term weights and length
-	queryTermToWeight, queryLength, err := processQuery(query)
-	if err != nil {
-		return nil, err
-	}
+	queryTermToWeight, queryLength := processQuery(query.Terms, dictionary)
+	timings[stageAnalysis], stageStart = time.Since(stageStart), time.Now()
 
 	// create transaction for fetching posting lists and document lengths
-	itx, err := idb.Begin()
+	itx, err := idb.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return searchResults{}, searchContextError(ctx, err)
 	}
+	defer itx.Rollback()
 
-	// get the posting list of each term in the query
+	// get the posting list of each term in the query, excluded terms
+	// included since matching needs them
+	var allTerms = make(map[string]bool)
+	query.Match.terms(allTerms)
 	var termToPostingList = make(map[string]map[int]int)
-	for term, _ := range queryTermToWeight {
+	for term := range allTerms {
 		_, inDictionary := dictionary[term]
 		if inDictionary {
-			postingList, err := getPostingList(itx, term)
+			postingList, err := getPostingList(ctx, itx, term)
 			if err != nil {
-				itx.Rollback()
-				return nil, err
+				return searchResults{}, searchContextError(ctx, err)
 			}
 
 			termToPostingList[term] = postingList
 		}
 	}
+	timings[stagePostingFetch], stageStart = time.Since(stageStart), time.Now()
 
-	// create a slice containing the query terms
-	var sortedQueryTerms []string
-	for term, _ := range queryTermToWeight {
-		sortedQueryTerms = append(sortedQueryTerms, term)
-	}
-
-	// debug code for checking idf order before sorting
-	// for _, term := range sortedQueryTerms {
-	// 	fmt.Print(dictionary[term], " ")
-	// }
-	// fmt.Println("eof")
-
-	// sort query terms by idf
-	// switch to slices.SortFunc
-	sort.Slice(sortedQueryTerms, func(i, j int) bool {
-		iIdf, hasI := dictionary[sortedQueryTerms[i]]
-		if !hasI {
-			iIdf = 0
-		}
-
-		jIdf, hasJ := dictionary[sortedQueryTerms[j]]
-		if !hasJ {
-			jIdf = 0
-		}
-
-		return iIdf > jIdf
-	})
+	// create a slice containing the query terms sorted by idf
+	sortedQueryTerms := sortTermsByIdf(queryTermToWeight, dictionary)
 
 	// create transaction for getting pagerank scores
-	ctx, err := cdb.Begin()
+	colTx, err := cdb.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
+		return searchResults{}, searchContextError(ctx, err)
 	}
+	defer colTx.Rollback()
 
+	// site and url filters need the fields the indexer stores
+	filterFields := query.Filters.hasFieldFilters()
+	if (filterFields || len(query.Facets) > 0 || query.Collapse.Field != "") && gen.fields == nil {
+		return searchResults{}, errFieldsUnavailable
+	}
+
+	// how much more or less often each document was clicked for this query
+	// than its positions predict
+	var docIdToClickBoost map[int]float64
+	if ranking.ClickWeight > 0 {
+		docIdToClickBoost = clickBoosts.forQuery(query.Text)
+	}
+
+	var partial bool
 	var docIdToSimilarity = make(map[int]float64)
+	var docIdToPagerank = make(map[int]float64)
+	var seen = make(map[int]bool)
 	// search by highest idf term to lowest idf term
+scoring:
 	for _, loopTerm := range sortedQueryTerms {
-		// cut off if idf is 0
-		// idf, hasIdf := dictionary[loopTerm]
-		// if !hasIdf || (hasIdf && idf == 0) {
-		// 	continue
-		// }
-
 		// calculate the cosine similarity between a document and the query
+		for _, docId := range candidateOrder(termToPostingList[loopTerm]) {
+			if seen[docId] {
+				continue
+			}
+			seen[docId] = true
 
-		for docId, _ := range termToPostingList[loopTerm] {
-			_, hasScore := docIdToSimilarity[docId]
-			if hasScore {
+			// documents containing a term may still fail a required or
+			// excluded one
+			if !query.Match.matches(docId, termToPostingList) {
 				continue
 			}
 
+			// filter on fields before paying for any lookups
+			if filterFields && !query.Filters.allows(gen.fields[docId]) {
+				continue
+			}
+			if slices.Contains(query.Filters.ExcludeDocIds, docId) {
+				continue
+			}
+
+			// stop scoring once the budget is spent or enough candidates have
+			// been scored, keeping what was scored. Both cut the same fixed
+			// order, a timeout just cuts it sooner.
+			if budgetSpent(ctx) || len(docIdToSimilarity) >= maxCandidates {
+				partial = true
+				break scoring
+			}
+
+			// fetch document pagerank score
+			documentPageRank, err := getDocumentPagerank(ctx, colTx, docId)
+			if err != nil && ctx.Err() != nil {
+				partial = true
+				break scoring
+			} else if err != nil {
+				return searchResults{}, err
+			}
+
+			if documentPageRank < query.Filters.MinPagerank {
+				continue
+			}
+
+			// terms of the title and url, for profiles that boost them
+			var fieldTerms map[string]map[string]bool
+			if len(ranking.FieldBoosts) > 0 {
+				fieldTerms, err = getDocumentFieldTerms(ctx, colTx, docId)
+				if err != nil && ctx.Err() != nil {
+					partial = true
+					break scoring
+				} else if err != nil {
+					return searchResults{}, err
+				}
+			}
+
 			// find each term in the query that is also in this document
 			var documentWordToWeight = make(map[string]float64)
 			for _, calcTerm := range sortedQueryTerms {
@@ -189,27 +297,17 @@ func search(idb *sql.DB, cdb *sql.DB, query string, cosineWeight float64, pagera
 
 				if hasDoc {
 					// calculate the term frequency of document
-					var tf float64 = 0
-					if docFrequency > 0 {
-						tf = float64(1) + math.Log10(float64(docFrequency))
-					}
-
-					documentWordToWeight[calcTerm] = tf * dictionary[calcTerm]
+					documentWordToWeight[calcTerm] = logTermFrequency(docFrequency) * dictionary[calcTerm] * ranking.fieldBoost(calcTerm, fieldTerms)
 				}
 			}
 
 			// fetch document length
-			documentLength, err := getDocumentLength(itx, docId)
-			if err != nil {
-				_ = itx.Rollback()
-				return nil, err
-			}
-
-			// fetch document pagerank score
-			documentPageRank, err := getDocumentPagerank(ctx, docId)
-			if err != nil {
-				_ = ctx.Rollback()
-				return nil, err
+			documentLength, err := getDocumentLength(ctx, itx, docId)
+			if err != nil && ctx.Err() != nil {
+				partial = true
+				break scoring
+			} else if err != nil {
+				return searchResults{}, err
 			}
 
 			// calculate cosine similarity
@@ -218,60 +316,170 @@ func search(idb *sql.DB, cdb *sql.DB, query string, cosineWeight float64, pagera
 				queryTermWeight, hasQueryTermWeight := queryTermToWeight[word]
 				documentTermWeight, hasDocumentTermWeight := documentWordToWeight[word]
 
-				// fmt.Println(queryTermWeight, documentTermWeight)
 				if hasQueryTermWeight && hasDocumentTermWeight {
 					numerator += (documentTermWeight * queryTermWeight)
 				}
 			}
 
-			var cosineSimilarity float64 = 0
-			if documentLength > 0 && queryLength > 0 {
-				cosineSimilarity = numerator / (documentLength * queryLength)
+			similarity := ranking.similarity(numerator, documentLength, queryLength)
+			normalizedPagerank := ranking.normalizePagerank(documentPageRank, gen.maxPagerank)
+			docIdToSimilarity[docId] = blendScore(similarity, normalizedPagerank, ranking.CosineWeight, ranking.PagerankWeight) * ranking.clickBoost(docIdToClickBoost[docId])
+			docIdToPagerank[docId] = documentPageRank
+		}
+	}
+
+	timings[stageScoring], stageStart = time.Since(stageStart), time.Now()
+
+	// a client that went away gets nothing, and running out of budget
+	// before a single document was scored leaves nothing to return
+	if partial && errors.Is(ctx.Err(), context.Canceled) {
+		return searchResults{}, ctx.Err()
+	} else if partial && len(docIdToSimilarity) == 0 {
+		return searchResults{}, errSearchTimeout
+	}
+
+	// rank the scored documents, ties broken by docId for stable pages
+	var docIds []int
+	for docId := range docIdToSimilarity {
+		docIds = append(docIds, docId)
+	}
+	sort.Slice(docIds, func(i, j int) bool {
+		if query.Sort == sortPagerank {
+			iPagerank, jPagerank := docIdToPagerank[docIds[i]], docIdToPagerank[docIds[j]]
+			if iPagerank != jPagerank {
+				return iPagerank > jPagerank
 			}
+		}
 
-			// fmt.Println(numerator, documentLength, queryLength, cosineSimilarity)
-			docIdToSimilarity[docId] = (cosineSimilarity * cosineWeight) + (documentPageRank * pagerankWeight)
+		iSimilarity, jSimilarity := docIdToSimilarity[docIds[i]], docIdToSimilarity[docIds[j]]
+		if iSimilarity == jSimilarity {
+			return docIds[i] < docIds[j]
 		}
+
+		return iSimilarity > jSimilarity
+	})
+
+	// the transactions die with an expired context, so documents for partial
+	// results are fetched outside of them under a short grace period
+	docQuerier, indexQuerier := sqlQuerier(colTx), sqlQuerier(itx)
+	docCtx := ctx
+	if partial {
+		var cancel context.CancelFunc
+		docCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), partialResultGrace)
+		defer cancel()
+		docQuerier, indexQuerier = cdb, idb
 	}
 
-	// commit all index db operations
-	if err := itx.Commit(); err != nil {
-		return nil, err
+	// re-rank the top results so near duplicates do not crowd each other
+	if query.Diversify.Depth > 0 {
+		if !gen.termVectors {
+			return searchResults{}, errTermVectorsUnavailable
+		}
+
+		docIds, err = diversify(docCtx, indexQuerier, docIds, docIdToSimilarity, dictionary, query.Diversify)
+		if err != nil {
+			return searchResults{}, searchContextError(docCtx, err)
+		}
+		timings[stageDiversification], stageStart = time.Since(stageStart), time.Now()
 	}
 
-	// return only top 10 results
+	// facets count the whole matching set, not just the page
+	var facets map[string]facetResult
+	if len(query.Facets) > 0 {
+		facets = countFacets(gen.fields, docIds, query.Facets)
+	}
+
+	// collapse before cutting the page so it is still full
+	var docIdToGroup map[int]string
+	var groupToHidden map[string]int
+	if query.Collapse.Field != "" {
+		docIds, docIdToGroup, groupToHidden = collapseResults(gen.fields, docIds, query.Collapse)
+	}
+
+	// keep only the requested page
+	pageStart := min(query.Offset, len(docIds))
+	pageEnd := min(pageStart+query.Limit, len(docIds))
+
 	var pairs []searchResult
-	for docId, similarity := range docIdToSimilarity {
-		var url string
-		row := ctx.QueryRow("SELECT url FROM docIdToData WHERE docId = ?", docId)
-		err := row.Scan(&url)
+	for _, docId := range docIds[pageStart:pageEnd] {
+		var url, title, body string
+		row := docQuerier.QueryRowContext(docCtx, "SELECT url, title, body FROM docIdToData WHERE docId = ?", docId)
+		err := row.Scan(&url, &title, &body)
 		if err != nil {
-			_ = ctx.Rollback()
-			return nil, err
+			return searchResults{}, searchContextError(docCtx, err)
+		}
+
+		var snippet string
+		if query.Highlight.Snippet {
+			snippet = makeSnippet(body, query.Terms, query.Highlight.Words)
+			if query.Highlight.Markup {
+				snippet = string(highlight(snippet, query.Terms))
+			}
 		}
 
-		//fmt.Println(docId, cosineSimilarity)
-		pairs = append(pairs, searchResult{DocUrl: url, Similarity: similarity})
+		pairs = append(pairs, searchResult{
+			DocId:       docId,
+			DocUrl:      url,
+			Title:       strings.TrimSpace(title),
+			Snippet:     snippet,
+			Similarity:  docIdToSimilarity[docId],
+			Group:       docIdToGroup[docId],
+			MoreInGroup: groupToHidden[docIdToGroup[docId]],
+		})
 	}
 
-	// commit all collection db operations
-	if err := ctx.Commit(); err != nil {
-		return nil, err
+	// commit all index and collection db operations
+	if !partial {
+		if err := itx.Commit(); err != nil {
+			return searchResults{}, err
+		}
+
+		if err := colTx.Commit(); err != nil {
+			return searchResults{}, err
+		}
 	}
 
-	sort.Slice(pairs, func(i, j int) bool {
-		return pairs[i].Similarity > pairs[j].Similarity
-	})
+	timings[stageResultAssembly] = time.Since(stageStart)
+
+	return searchResults{
+		Results: pairs,
+		Total:   len(docIdToSimilarity),
+		Partial: partial,
+		Facets:  facets,
+		Hidden:  len(docIdToSimilarity) - len(docIds),
+		Timings: timings,
+	}, nil
+}
 
-	topN := 10
-	if len(pairs) < topN {
-		topN = len(pairs)
+// implemented by both *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// how long result assembly may take once the search budget is spent
+var partialResultGrace = 250 * time.Millisecond
+
+// true once ctx is done or its deadline has passed, the deadline is
+// checked directly since the timer that cancels ctx can fire late
+func budgetSpent(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
 	}
-	top10 := pairs[:topN]
 
-	// for i, pair := range pairs {
-	// 	fmt.Println(i, pair)
-	// }
+	deadline, hasDeadline := ctx.Deadline()
+	return hasDeadline && time.Now().After(deadline)
+}
+
+// reports an expired budget as a timeout and keeps cancellations
+// recognisable, any other error is returned unchanged
+func searchContextError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errSearchTimeout
+	}
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return ctx.Err()
+	}
 
-	return top10, nil
+	return err
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCandidateOrder(t *testing.T) {
+	tests := []struct {
+		name        string
+		postingList map[int]int
+		want        []int
+	}{
+		{"empty", map[int]int{}, []int{}},
+		{"by frequency", map[int]int{3: 1, 7: 4, 1: 2}, []int{7, 1, 3}},
+		{"ties by docId", map[int]int{9: 2, 4: 2, 6: 5, 2: 2}, []int{6, 2, 4, 9}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// map iteration order changes between runs, the order must not
+			for range 20 {
+				got := candidateOrder(test.postingList)
+				if !slices.Equal(got, test.want) {
+					t.Fatalf("candidateOrder() = %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
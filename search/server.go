@@ -1,90 +1,552 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/KevinBasta/yam-search/common"
 )
 
-var indexDB string = "../out/index.db"
 var collectionDB string = "../out/document_collection.db"
-var cosineWeight float64 = 0.9
-var pagerankWeight float64 = 1 - cosineWeight
-var idb *sql.DB
-var cdb *sql.DB
+var stopWordsPath string = "../out/stopwords.txt"
+
+// time budget for a query, a request may lower or raise it up to the max
+var searchTimeout time.Duration = 2 * time.Second
+var maxSearchTimeout time.Duration = 10 * time.Second
 
 type Response struct {
-	Results []searchResult `json:"results"`
+	Results []searchResult         `json:"results"`
+	Total   int                    `json:"total"`
+	Partial bool                   `json:"partial,omitempty"`
+	Facets  map[string]facetResult `json:"facets,omitempty"`
+	Hidden  int                    `json:"hidden,omitempty"`
+}
+
+// query settings used where a request does not override them
+func defaultSearchQuery() searchQuery {
+	return searchQuery{
+		Sort:      sortRelevance,
+		Limit:     defaultLimit,
+		Ranking:   rankingProfiles[defaultProfileName],
+		Highlight: defaultHighlight,
+		Collapse:  collapseOptions{PerGroup: defaultPerGroup},
+	}
+}
+
+// reads the query text and options shared by the api and the ui
+func parseSearchQuery(r *http.Request) (searchQuery, error) {
+	query := defaultSearchQuery()
+	query.Text = r.URL.Query().Get("q")
+
+	if strings.TrimSpace(query.Text) == "" {
+		return query, errEmptyQuery
+	}
+
+	err := compileQueryText(&query)
+	if err != nil {
+		return query, err
+	}
+
+	return query, parseSearchOptions(r, &query)
+}
+
+// reads the filter, paging, facet, collapse, diversify and ranking
+// parameters every kind of GET query shares
+func parseSearchOptions(r *http.Request, query *searchQuery) error {
+	var err error
+
+	// filter parameters add to the operators in the text
+	filterParams := []struct {
+		param    string
+		operator string
+		excluded bool
+	}{
+		{"site", "site", false},
+		{"excludeSite", "site", true},
+		{"inurl", "inurl", false},
+		{"excludeInurl", "inurl", true},
+	}
+	for _, filter := range filterParams {
+		for _, value := range r.URL.Query()[filter.param] {
+			if strings.TrimSpace(value) != "" {
+				query.Filters.add(filter.operator, value, filter.excluded)
+			}
+		}
+	}
+
+	offsetParam := r.URL.Query().Get("offset")
+	if offsetParam != "" {
+		query.Offset, err = strconv.Atoi(offsetParam)
+		if err != nil || query.Offset < 0 {
+			return errInvalidPaging
+		}
+	}
+
+	limitParam := r.URL.Query().Get("limit")
+	if limitParam != "" {
+		query.Limit, err = strconv.Atoi(limitParam)
+		if err != nil || query.Limit < 1 || query.Limit > maxLimit {
+			return errInvalidPaging
+		}
+	}
+
+	query.Facets, err = parseFacets(splitList(r.URL.Query().Get("facets")))
+	if err != nil {
+		return err
+	}
+
+	query.Collapse.Field = r.URL.Query().Get("collapse")
+	perGroupParam := r.URL.Query().Get("perGroup")
+	if perGroupParam != "" {
+		query.Collapse.PerGroup, err = strconv.Atoi(perGroupParam)
+		if err != nil {
+			return invalidRequest("perGroup must be an integer")
+		}
+	}
+	err = checkCollapse(query.Collapse)
+	if err != nil {
+		return err
+	}
+
+	query.Diversify, err = parseDiversify(r)
+	if err != nil {
+		return err
+	}
+
+	query.Ranking, err = parseRanking(r)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// a lambda parameter turns on diversification of the top diversifyDepth
+// results
+func parseDiversify(r *http.Request) (diversifyOptions, error) {
+	lambdaParam := r.URL.Query().Get("lambda")
+	if lambdaParam == "" {
+		return diversifyOptions{}, nil
+	}
+
+	options := diversifyOptions{Depth: defaultDiversifyDepth}
+	var err error
+	options.Lambda, err = strconv.ParseFloat(lambdaParam, 64)
+	if err != nil {
+		return options, invalidRequest("lambda must be a number")
+	}
+
+	depthParam := r.URL.Query().Get("diversifyDepth")
+	if depthParam != "" {
+		options.Depth, err = strconv.Atoi(depthParam)
+		if err != nil || options.Depth < 1 {
+			return options, invalidRequest("diversify depth must be between 1 and %d", maxDiversifyDepth)
+		}
+	}
+
+	return options, checkDiversify(options)
+}
+
+// picks the ranking profile named by the profile parameter, with weights
+// overridden by cosineWeight, pagerankWeight and clickWeight for callers
+// allowed to
+func parseRanking(r *http.Request) (rankingProfile, error) {
+	ranking, err := lookupProfile(r.URL.Query().Get("profile"))
+	if err != nil {
+		return ranking, err
+	}
+
+	overrides := map[string]*float64{
+		"cosineWeight":   &ranking.CosineWeight,
+		"pagerankWeight": &ranking.PagerankWeight,
+		"clickWeight":    &ranking.ClickWeight,
+	}
+	for param, weight := range overrides {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+
+		if !canOverrideRanking(r) {
+			return ranking, errRankingOverride
+		}
+
+		*weight, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return ranking, invalidRequest("%s must be a number", param)
+		}
+	}
+
+	return ranking, checkProfile(ranking)
+}
+
+// reads a json query from the body of a POST /search, see searchRequestBody
+func decodeSearchQuery(w http.ResponseWriter, r *http.Request) (searchQuery, error) {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	decoder.DisallowUnknownFields()
+
+	var body searchRequestBody
+	err := decoder.Decode(&body)
+	if err != nil {
+		return searchQuery{}, invalidRequest("body is not a valid query: %v", err)
+	}
+	if decoder.More() {
+		return searchQuery{}, invalidRequest("body must hold a single json object")
+	}
+
+	return compileSearchBody(body, defaultSearchQuery(), canOverrideRanking(r))
+}
+
+// derives the query deadline from the request context, honouring a
+// timeout parameter such as timeout=500ms
+func searchContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	timeout := searchTimeout
+
+	timeoutParam := r.URL.Query().Get("timeout")
+	if timeoutParam != "" {
+		requested, err := time.ParseDuration(timeoutParam)
+		if err != nil || requested <= 0 {
+			return nil, nil, errInvalidTimeout
+		}
+
+		timeout = min(requested, maxSearchTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
+// encodes a successful json response
+func writeJSON(w http.ResponseWriter, r *http.Request, value any) {
+	writeJSONStatus(w, r, http.StatusOK, value)
+}
+
+func writeJSONStatus(w http.ResponseWriter, r *http.Request, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		fmt.Println("request", requestIdFrom(r.Context()), "failed to write response:", err)
+	}
 }
 
+// GET takes the query in url parameters, POST takes a json query body
 func searchHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
+	var query searchQuery
+	var err error
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		query, err = parseSearchQuery(r)
+	case http.MethodPost:
+		query, err = decodeSearchQuery(w, r)
+	default:
+		err = errMethodNotAllowed
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	results, err := search(idb, cdb, query, cosineWeight, pagerankWeight)
+	gen, err := acquireGeneration()
 	if err != nil {
-		fmt.Println(err)
+		writeError(w, r, err)
+		return
 	}
+	defer gen.release()
+
+	ctx, cancel, err := searchContext(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer cancel()
+
+	start := time.Now()
+	results, err := search(ctx, gen, query)
+	latency := time.Since(start)
+	logQuery(clientId(r), "/search", query, results, latency, err)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	observeSearch(latency, results)
 
 	response := Response{
-		Results: results,
+		Results: results.Results,
+		Total:   results.Total,
+		Partial: results.Partial,
+		Facets:  results.Facets,
+		Hidden:  results.Hidden,
 	}
 
-	w.Header().Set("Access-Control-Allow-Origin", "null")
-	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, r, response)
+	fmt.Println("served query:", query.Text)
+}
 
-	err = json.NewEncoder(w).Encode(response)
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := parseSearchQuery(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	fmt.Println("served query:", query)
+	docId, err := strconv.Atoi(r.URL.Query().Get("docId"))
+	if err != nil {
+		writeError(w, r, errInvalidDocId)
+		return
+	}
+
+	gen, err := acquireGeneration()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer gen.release()
+
+	ctx, cancel, err := searchContext(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer cancel()
+
+	explanation, err := explain(ctx, gen, query, docId)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, explanation)
+	fmt.Println("explained query:", query.Text, "docId:", docId)
+}
+
+// registers an api route wrapped in the middleware every route shares
+func handleRoute(route string, handler http.Handler) {
+	http.Handle(route, withMetrics(route, withRequestId(withCORS(handler))))
 }
 
+// admin routes are never answered to other origins, so a page in a browser
+// on the server's machine cannot use them
+func handleAdminRoute(route string, handler http.Handler) {
+	http.Handle(route, withMetrics(route, withRequestId(adminOnly(handler))))
+}
+
+// exit statuses reported by main
+const (
+	exitOk            = 0
+	exitStartupFailed = 1
+	exitServeFailed   = 2
+	exitDrainTimeout  = 3
+)
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "analyze":
+			os.Exit(runAnalyze(os.Args[2:]))
+		case "eval":
+			os.Exit(runEval(os.Args[2:]))
+		}
+	}
+
+	os.Exit(run())
+}
+
+// run owns every resource main opens so its deferred closes happen before
+// the process exits with the returned status
+func run() int {
+	var drainTimeout time.Duration
+	var watchInterval time.Duration
+	flag.DurationVar(&searchTimeout, "timeout", searchTimeout, "default time budget for a query")
+	flag.DurationVar(&maxSearchTimeout, "max-timeout", maxSearchTimeout, "largest time budget a request may ask for")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 15*time.Second, "how long in-flight requests may run after a shutdown signal")
+	flag.DurationVar(&watchInterval, "watch-interval", 10*time.Second, "how often to check for a new index generation, 0 disables")
+	corsOrigins := flag.String("cors-origins", strings.Join(corsAllowedOrigins, ","), "comma separated origins allowed to call the api, * for any")
+	corsMethods := flag.String("cors-methods", strings.Join(corsAllowedMethods, ","), "comma separated methods allowed in cross origin requests")
+	corsHeaders := flag.String("cors-headers", strings.Join(corsAllowedHeaders, ","), "comma separated request headers allowed in cross origin requests")
+	flag.DurationVar(&corsMaxAge, "cors-max-age", corsMaxAge, "how long browsers may cache a preflight response")
+	flag.Float64Var(&rateLimit, "rate", rateLimit, "requests per second allowed per client, 0 disables rate limiting")
+	flag.Float64Var(&rateBurst, "burst", rateBurst, "requests a client may make in a burst")
+	flag.IntVar(&maxQueryTerms, "max-query-terms", maxQueryTerms, "most distinct analyzed terms a query may have")
+	flag.IntVar(&maxBatchQueries, "max-batch-queries", maxBatchQueries, "most queries a /msearch batch may hold")
+	flag.IntVar(&batchConcurrency, "batch-concurrency", batchConcurrency, "queries of one batch run at once")
+	flag.IntVar(&maxCandidates, "max-candidates", maxCandidates, "most documents scored for one query")
+	flag.StringVar(&apiKeysPath, "api-keys", apiKeysPath, "json file of api keys, requests need a key when set")
+	flag.BoolVar(&serveUI, "ui", serveUI, "serve the search page at /")
+	flag.BoolVar(&trustLoopback, "trust-loopback", trustLoopback, "let requests from the same machine use admin routes and override ranking, leave off behind a reverse proxy")
+	flag.StringVar(&rankingProfilesPath, "ranking-profiles", rankingProfilesPath, "json file of named ranking profiles")
+	flag.StringVar(&queryLogPath, "query-log", queryLogPath, "file to append answered queries to, empty disables the query log")
+	flag.StringVar(&clickLogPath, "click-log", clickLogPath, "file to append result clicks to, empty disables click logging and boosting")
+	flag.Int64Var(&logMaxSize, "log-max-size", logMaxSize, "bytes the query and click logs may grow to before they are rotated")
+	flag.IntVar(&logKeep, "log-keep", logKeep, "rotated files to keep of each log")
+	flag.Parse()
+	corsAllowedOrigins = splitList(*corsOrigins)
+	corsAllowedMethods = splitList(*corsMethods)
+	corsAllowedHeaders = splitList(*corsHeaders)
+
 	// Load stop words for query processing
-	stopWordsPath := "../out/stopwords.txt"
 	err := common.LoadStopWords(stopWordsPath)
 	if err != nil {
 		fmt.Println(err)
 	}
 
-	// No longer need total docs as idf is calculated by indexer
-	// totalDocs, err := loadTotalDocs(indexDB)
-	// if err != nil {
-	// 	fmt.Println(err)
-	// }
-	// fmt.Println("total docs: ", totalDocs)
+	if rankingProfilesPath != "" {
+		err = loadRankingProfiles(rankingProfilesPath)
+		if err != nil {
+			fmt.Println("loading ranking profiles:", err)
+			return exitStartupFailed
+		}
+	}
 
-	// load docId -> idf mapping for cosine similarity
-	dictionaryDB := "../out/dictionary.db"
-	err = loadDictionary(dictionaryDB)
+	// load the dictionary and open the databases of the newest generation,
+	// queries are answered with 503 until one loads
+	_, err = reloadGeneration(false)
 	if err != nil {
 		fmt.Println(err)
 	}
-	// for key, val := range dictionary { println(key, val) }
+	defer retireGeneration()
+
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	if watchInterval > 0 {
+		go watchGenerationMarker(watchInterval, stopWatching)
+	}
+	go pruneRateLimiter(time.Minute, stopWatching)
+
+	// api keys are optional, without a key file the api stays open
+	if apiKeysPath != "" {
+		apiKeys, err = loadAPIKeys(apiKeysPath)
+		if err != nil {
+			fmt.Println("loading api keys:", err)
+			return exitStartupFailed
+		}
+		defer saveAPIKeys()
+		go apiKeys.saveUsage(time.Minute, stopWatching)
+	}
+
+	// past queries are read for suggestions before new ones are appended
+	if queryLogPath != "" {
+		pastQueries, err = loadPastQueries(queryLogPath)
+		if err != nil {
+			fmt.Println("reading query log:", err)
+			return exitStartupFailed
+		}
+		go pastQueries.maintainEvery(pastQueryRebuildInterval, stopWatching)
+
+		queryLogger, err = openAppendLog(queryLogPath)
+		if err != nil {
+			fmt.Println("opening query log:", err)
+			return exitStartupFailed
+		}
+		defer queryLogger.close()
+	}
+
+	// clicks are weighed against where the query log shows the results were
+	if queryLogPath != "" && clickLogPath != "" {
+		clickBoosts, err = loadClickModel(queryLogPath, clickLogPath)
+		if err != nil {
+			fmt.Println("reading click log:", err)
+			return exitStartupFailed
+		}
+		go clickBoosts.maintainEvery(clickRebuildInterval, stopWatching)
+
+		clickLogger, err = openAppendLog(clickLogPath)
+		if err != nil {
+			fmt.Println("opening click log:", err)
+			return exitStartupFailed
+		}
+		defer clickLogger.close()
+	}
+
+	// register endpoints and start server on port 8080
+	handleRoute("/search", withAPIKey(withRateLimit(withQuota(http.HandlerFunc(searchHandler)))))
+	// batches are charged per query once their size is known
+	handleRoute("/msearch", withAPIKey(http.HandlerFunc(multiSearchHandler)))
+	handleRoute("/similar", withAPIKey(withRateLimit(withQuota(http.HandlerFunc(similarHandler)))))
+	handleRoute("/explain", withAPIKey(withRateLimit(withQuota(http.HandlerFunc(explainHandler)))))
+	handleRoute("/metrics", http.HandlerFunc(metricsHandler))
+	handleRoute("/healthz", http.HandlerFunc(healthzHandler))
+	handleRoute("/readyz", http.HandlerFunc(readyzHandler))
+	handleRoute("/doc", withAPIKey(withRateLimit(withQuota(http.HandlerFunc(docHandler)))))
+	handleRoute("/doc/{id}", withAPIKey(withRateLimit(withQuota(http.HandlerFunc(docHandler)))))
+	handleRoute("/terms", withAPIKey(withRateLimit(withQuota(http.HandlerFunc(termsHandler)))))
+	handleRoute("/stats", withAPIKey(withRateLimit(withQuota(http.HandlerFunc(statsHandler)))))
+	handleRoute("/suggest", withAPIKey(withRateLimit(withQuota(http.HandlerFunc(suggestHandler)))))
+	// browsers cannot send a key header, so the page, its result links and
+	// cached copies are only rate limited by address. "/{$}" matches the page
+	// alone, other paths get the mux's 404 before any middleware runs.
+	handleRoute("/click", withRateLimit(http.HandlerFunc(clickHandler)))
+	if serveUI {
+		handleRoute("/{$}", withRateLimit(http.HandlerFunc(uiHandler)))
+		handleRoute("/cache/{id}", withRateLimit(http.HandlerFunc(cacheHandler)))
+	}
+	handleAdminRoute("/admin/reload", http.HandlerFunc(reloadHandler))
+	handleAdminRoute("/admin/keys", http.HandlerFunc(keysHandler))
+	handleAdminRoute("/admin/keys/{id}", http.HandlerFunc(revokeKeyHandler))
+	server := &http.Server{
+		Addr:              ":8080",
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      maxSearchTimeout + 5*time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		fmt.Println("Server starting on http://localhost:8080")
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		fmt.Println("server stopped:", err)
+		return exitServeFailed
+	case <-stop.Done():
+		cancel()
+	}
+
+	// stop accepting connections and let in-flight queries finish
+	fmt.Println("shutting down, draining requests for up to", drainTimeout)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancelDrain()
 
-	// Open databases for faster reads
-	idb, err = sql.Open("sqlite", indexDB)
+	err = server.Shutdown(drainCtx)
 	if err != nil {
-		fmt.Println(err)
-		return
+		// cut off whatever is still running so the databases can close
+		fmt.Println("drain incomplete:", err)
+		server.Close()
+		return exitDrainTimeout
 	}
-	defer idb.Close()
 
-	cdb, err = sql.Open("sqlite", collectionDB)
+	fmt.Println("server shut down cleanly")
+	return exitOk
+}
+
+// keeps usage counted since the last periodic save
+func saveAPIKeys() {
+	err := apiKeys.save()
 	if err != nil {
-		fmt.Println(err)
-		return
+		fmt.Println("saving api keys:", err)
 	}
-	defer cdb.Close()
+}
 
-	// register search endpoint and start server on port 8080
-	http.HandleFunc("/search", searchHandler)
-	fmt.Println("Server starting on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+func closeDatabase(name string, db *sql.DB) {
+	err := db.Close()
+	if err != nil {
+		fmt.Println("closing", name, "database:", err)
+	}
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// terms of the source document a more-like-this query uses by default
+var defaultSimilarTerms = 10
+
+// the source document's highest weighted terms, as a query weighted the way
+// the document weights them
+func similarQuery(ctx context.Context, gen *indexGeneration, docId int, termCount int, base searchQuery) (searchQuery, []string, error) {
+	if !gen.termVectors {
+		return base, nil, errTermVectorsUnavailable
+	}
+
+	frequencies, err := getTermFrequencies(ctx, gen.idb, docId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return base, nil, errDocumentNotFound
+	} else if err != nil {
+		return base, nil, searchContextError(ctx, err)
+	}
+	vector := unitTermVector(frequencies, gen.dictionary)
+
+	// highest weight first, ties broken by term so the query is stable
+	terms := make([]string, 0, len(vector))
+	for term := range vector {
+		terms = append(terms, term)
+	}
+	slices.SortFunc(terms, func(a, b string) int {
+		if vector[a] != vector[b] {
+			if vector[a] > vector[b] {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	terms = terms[:min(termCount, len(terms))]
+	if len(terms) == 0 {
+		return base, nil, errNoQueryTerms
+	}
+
+	// querying with the document's own frequencies gives each term the
+	// tf-idf weight it has in the document
+	query := base
+	query.Match = &queryNode{Op: "or"}
+	query.Terms = make(map[string]queryTerm)
+	for _, term := range terms {
+		query.Match.Children = append(query.Match.Children, &queryNode{Op: "term", Term: term})
+		query.Terms[term] = queryTerm{Frequency: frequencies[term], Boost: 1}
+	}
+	query.Filters.ExcludeDocIds = append(query.Filters.ExcludeDocIds, docId)
+
+	return query, terms, nil
+}
+
+// the docId of the document crawled from url
+func lookupDocId(ctx context.Context, gen *indexGeneration, url string) (int, error) {
+	var docId int
+	row := gen.cdb.QueryRowContext(ctx, "SELECT docId FROM docIdToData WHERE url = ?", strings.TrimSpace(url))
+	err := row.Scan(&docId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errDocumentNotFound
+	} else if err != nil {
+		return 0, searchContextError(ctx, err)
+	}
+
+	return docId, nil
+}
+
+type similarResponse struct {
+	DocId int      `json:"docId"`
+	Terms []string `json:"terms"` // analyzed terms the query was built from
+	Response
+}
+
+// GET /similar?docId= or ?url= finds documents like the given one, taking
+// the same paging, filter and ranking parameters as /search
+func similarHandler(w http.ResponseWriter, r *http.Request) {
+	docIdParam, urlParam := r.URL.Query().Get("docId"), r.URL.Query().Get("url")
+	if (docIdParam == "") == (urlParam == "") {
+		writeError(w, r, invalidRequest("exactly one of docId and url is required"))
+		return
+	}
+
+	termCount := defaultSimilarTerms
+	termsParam := r.URL.Query().Get("terms")
+	if termsParam != "" {
+		var err error
+		termCount, err = strconv.Atoi(termsParam)
+		if err != nil || termCount < 1 || termCount > maxQueryTerms {
+			writeError(w, r, invalidRequest("terms must be between 1 and %d", maxQueryTerms))
+			return
+		}
+	}
+
+	base := defaultSearchQuery()
+	err := parseSearchOptions(r, &base)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	gen, err := acquireGeneration()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer gen.release()
+
+	ctx, cancel, err := searchContext(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer cancel()
+
+	var docId int
+	if docIdParam != "" {
+		docId, err = strconv.Atoi(docIdParam)
+		if err != nil {
+			writeError(w, r, errInvalidDocId)
+			return
+		}
+	} else {
+		docId, err = lookupDocId(ctx, gen, urlParam)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	query, terms, err := similarQuery(ctx, gen, docId, termCount, base)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	start := time.Now()
+	results, err := search(ctx, gen, query)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	observeSearch(time.Since(start), results)
+
+	writeJSON(w, r, similarResponse{
+		DocId: docId,
+		Terms: terms,
+		Response: Response{
+			Results: results.Results,
+			Total:   results.Total,
+			Partial: results.Partial,
+			Facets:  results.Facets,
+			Hidden:  results.Hidden,
+		},
+	})
+	fmt.Println("served similar documents for docId:", docId)
+}
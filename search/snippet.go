@@ -0,0 +1,92 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+
+	"github.com/KevinBasta/yam-search/common"
+)
+
+// words of context shown around the best match in a snippet
+var snippetWords = 30
+
+// picks the window of length words with the most query term occurrences,
+// falling back to the start of the body when nothing matches
+func makeSnippet(body string, queryTerms map[string]queryTerm, length int) string {
+	words := strings.Fields(body)
+	if len(words) == 0 {
+		return ""
+	}
+
+	var matches []bool
+	for _, word := range words {
+		term, ok := common.AnalyzeWord(word)
+		_, isQueryTerm := queryTerms[term]
+		matches = append(matches, ok && isQueryTerm)
+	}
+
+	// slide a window over the words, counting matches inside it
+	bestStart, bestCount, count := 0, 0, 0
+	for i := range words {
+		if matches[i] {
+			count++
+		}
+		if i >= length && matches[i-length] {
+			count--
+		}
+
+		if count > bestCount {
+			bestCount = count
+			bestStart = max(0, i-length+1)
+		}
+	}
+
+	end := min(len(words), bestStart+length)
+	snippet := strings.Join(words[bestStart:end], " ")
+	if bestStart > 0 {
+		snippet = "... " + snippet
+	}
+	if end < len(words) {
+		snippet += " ..."
+	}
+
+	return snippet
+}
+
+// escapes text for html and wraps every word that analyzes to a query
+// term in <mark>, keeping the original spacing
+func highlight(text string, queryTerms map[string]queryTerm) template.HTML {
+	var html strings.Builder
+
+	for len(text) > 0 {
+		// copy the whitespace before the next word
+		wordStart := strings.IndexFunc(text, func(r rune) bool { return !isSpace(r) })
+		if wordStart < 0 {
+			html.WriteString(template.HTMLEscapeString(text))
+			break
+		}
+		html.WriteString(template.HTMLEscapeString(text[:wordStart]))
+		text = text[wordStart:]
+
+		wordEnd := strings.IndexFunc(text, isSpace)
+		if wordEnd < 0 {
+			wordEnd = len(text)
+		}
+		word := text[:wordEnd]
+		text = text[wordEnd:]
+
+		term, ok := common.AnalyzeWord(word)
+		_, isQueryTerm := queryTerms[term]
+		if ok && isQueryTerm {
+			html.WriteString("<mark>" + template.HTMLEscapeString(word) + "</mark>")
+		} else {
+			html.WriteString(template.HTMLEscapeString(word))
+		}
+	}
+
+	return template.HTML(html.String())
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\v' || r == '\f'
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/KevinBasta/yam-search/common"
+)
+
+// largest edit distance a spelling suggestion may be from the query word
+var maxSpellingDistance = 2
+
+// the deadline is checked after this many candidates are compared
+const spellingCheckEvery = 256
+
+// rewrites query with every word whose term is not in the dictionary
+// replaced by the closest word of the collection as it was written,
+// preferring words in more documents on ties. + and - prefixes are kept.
+// Returns an empty string when every word is already known, nothing is
+// close, the generation has no unstemmed words or ctx runs out first.
+func spellingSuggestion(ctx context.Context, gen *indexGeneration, query string) string {
+	if gen.suggestions == nil {
+		return ""
+	}
+
+	words := strings.Fields(query)
+	changed := false
+
+	for i, word := range words {
+		// site: and inurl: values are not dictionary words
+		_, _, _, isOperator := queryOperator(word)
+		if isOperator {
+			continue
+		}
+
+		prefix := ""
+		if word[0] == '+' || word[0] == '-' {
+			prefix, word = word[:1], word[1:]
+		}
+
+		term, ok := common.AnalyzeWord(word)
+		if !ok {
+			continue
+		}
+
+		_, known := gen.dictionary[term]
+		if known {
+			continue
+		}
+
+		// surface forms are sorted by document frequency, so the first
+		// candidate at the best distance is the most common one
+		common.FormatWord(&word)
+		best, bestDistance := "", maxSpellingDistance+1
+		for j, candidate := range gen.suggestions.entries {
+			if j%spellingCheckEvery == 0 && budgetSpent(ctx) {
+				return ""
+			}
+
+			if abs(len(candidate.Text)-len(word)) >= bestDistance {
+				continue
+			}
+
+			distance := editDistance(word, candidate.Text)
+			if distance < bestDistance {
+				best, bestDistance = candidate.Text, distance
+			}
+		}
+
+		if best != "" {
+			words[i] = prefix + best
+			changed = true
+		}
+	}
+
+	if !changed {
+		return ""
+	}
+
+	return strings.Join(words, " ")
+}
+
+// levenshtein distance between a and b
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
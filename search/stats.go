@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KevinBasta/yam-search/common"
+)
+
+// postings listed per term unless a request asks otherwise, and the most
+// it may ask for
+var defaultPostingSample = 10
+var maxPostingSample = 100
+
+type postingEntry struct {
+	DocId     int `json:"docId"`
+	Frequency int `json:"frequency"`
+}
+
+// how the index sees one word of a query
+type termStats struct {
+	Word              string         `json:"word"`
+	Term              string         `json:"term,omitempty"` // analyzed and stemmed form
+	StopWord          bool           `json:"stopWord,omitempty"`
+	Indexed           bool           `json:"indexed"`
+	DocumentFrequency int            `json:"documentFrequency"`
+	Idf               float64        `json:"idf"`
+	PostingListLength int            `json:"postingListLength"`
+	Occurrences       int            `json:"occurrences"` // sum of the frequencies in the posting list
+	Postings          []postingEntry `json:"postings"`    // most frequent first
+}
+
+type termStatsResponse struct {
+	Terms []termStats `json:"terms"`
+}
+
+// collection wide numbers of the served generation
+type indexStats struct {
+	Generation            string    `json:"generation"`
+	LoadedAt              time.Time `json:"loadedAt"`
+	TotalDocs             int       `json:"totalDocs"`
+	VocabularySize        int       `json:"vocabularySize"`
+	AverageDocumentLength float64   `json:"averageDocumentLength"` // of the vectors used for cosine similarity
+	MaxPagerank           float64   `json:"maxPagerank"`
+	Fields                bool      `json:"fields"`
+	TermVectors           bool      `json:"termVectors"`
+}
+
+// statistics of each word of text, analyzed the way query words are
+func getTermStats(ctx context.Context, gen *indexGeneration, text string, sample int) ([]termStats, error) {
+	itx, err := gen.idb.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, searchContextError(ctx, err)
+	}
+	defer itx.Rollback()
+
+	stats := []termStats{}
+	for _, word := range strings.Fields(text) {
+		entry := termStats{Word: word, Postings: []postingEntry{}}
+
+		term, ok := common.AnalyzeWord(word)
+		if !ok {
+			formatted := word
+			common.FormatWord(&formatted)
+			_, entry.StopWord = common.StopWords[formatted]
+			stats = append(stats, entry)
+			continue
+		}
+		entry.Term = term
+
+		idf, inDictionary := gen.dictionary[term]
+		if !inDictionary {
+			stats = append(stats, entry)
+			continue
+		}
+		entry.Indexed = true
+		entry.Idf = idf
+
+		postingList, err := getPostingList(ctx, itx, term)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, searchContextError(ctx, err)
+		}
+
+		// a posting list holds one entry per document containing the term
+		entry.DocumentFrequency = len(postingList)
+		entry.PostingListLength = len(postingList)
+		for docId, frequency := range postingList {
+			entry.Occurrences += frequency
+			entry.Postings = append(entry.Postings, postingEntry{docId, frequency})
+		}
+
+		slices.SortFunc(entry.Postings, func(a, b postingEntry) int {
+			if a.Frequency != b.Frequency {
+				return b.Frequency - a.Frequency
+			}
+			return a.DocId - b.DocId
+		})
+		entry.Postings = entry.Postings[:min(sample, len(entry.Postings))]
+
+		stats = append(stats, entry)
+	}
+
+	return stats, nil
+}
+
+func getIndexStats(ctx context.Context, gen *indexGeneration) (indexStats, error) {
+	stats := indexStats{
+		Generation:     gen.name,
+		LoadedAt:       gen.loadedAt,
+		TotalDocs:      gen.totalDocs,
+		VocabularySize: len(gen.dictionary),
+		MaxPagerank:    gen.maxPagerank,
+		Fields:         gen.fields != nil,
+		TermVectors:    gen.termVectors,
+	}
+
+	var averageLength sql.NullFloat64
+	err := gen.idb.QueryRowContext(ctx, "SELECT AVG(length) FROM docIdToLength").Scan(&averageLength)
+	if err != nil {
+		return stats, searchContextError(ctx, err)
+	}
+	stats.AverageDocumentLength = averageLength.Float64
+
+	return stats, nil
+}
+
+// GET /terms?q= reports the stemmed form, document frequency, idf and a
+// sample of the posting list of each word of q
+func termsHandler(w http.ResponseWriter, r *http.Request) {
+	text := r.URL.Query().Get("q")
+	if strings.TrimSpace(text) == "" {
+		writeError(w, r, errEmptyQuery)
+		return
+	}
+	if len(strings.Fields(text)) > maxQueryTerms {
+		writeError(w, r, errTooManyTerms)
+		return
+	}
+
+	sample := defaultPostingSample
+	sampleParam := r.URL.Query().Get("sample")
+	if sampleParam != "" {
+		var err error
+		sample, err = strconv.Atoi(sampleParam)
+		if err != nil || sample < 0 || sample > maxPostingSample {
+			writeError(w, r, invalidRequest("sample must be between 0 and %d", maxPostingSample))
+			return
+		}
+	}
+
+	gen, err := acquireGeneration()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer gen.release()
+
+	ctx, cancel, err := searchContext(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer cancel()
+
+	stats, err := getTermStats(ctx, gen, text, sample)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, termStatsResponse{Terms: stats})
+	fmt.Println("served term stats:", text)
+}
+
+// GET /stats reports collection wide numbers of the served generation
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	gen, err := acquireGeneration()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer gen.release()
+
+	ctx, cancel, err := searchContext(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer cancel()
+
+	stats, err := getIndexStats(ctx, gen)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, r, stats)
+	fmt.Println("served index stats")
+}
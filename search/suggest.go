@@ -0,0 +1,349 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// completions returned unless a request asks otherwise, and the most each
+// trie node keeps so a lookup never has to walk the words below it
+var defaultSuggestions = 5
+var maxSuggestions = 10
+
+// where a suggestion came from
+const (
+	suggestionTerm  = "term"
+	suggestionQuery = "query"
+)
+
+// past queries are only suggested once this many searches with results
+// used them, so one user's query is not shown to others
+var minPastQueryCount = 2
+
+// how often older queries are dropped and new ones added to the past query
+// trie, and how far back queries count
+var pastQueryRebuildInterval = time.Minute
+var pastQueryWindow = 30 * 24 * time.Hour
+
+type suggestion struct {
+	Text   string `json:"text"`
+	Weight int    `json:"weight"` // document frequency of a term, or times a query was searched
+	Source string `json:"source"`
+}
+
+type suggestResponse struct {
+	Prefix      string       `json:"prefix"`
+	Suggestions []suggestion `json:"suggestions"`
+}
+
+// prefix tree over suggestions. Every node holds the best suggestions
+// below it, so a lookup costs the length of the prefix.
+type suggestionTrie struct {
+	root    *trieNode
+	entries []suggestion
+}
+
+type trieNode struct {
+	keys     []byte
+	children []*trieNode
+	best     []int32 // indexes of entries, best first
+}
+
+func (node *trieNode) child(key byte) *trieNode {
+	for i, k := range node.keys {
+		if k == key {
+			return node.children[i]
+		}
+	}
+
+	return nil
+}
+
+func newSuggestionTrie(entries []suggestion) *suggestionTrie {
+	// inserting the best entries first fills each node's list in order
+	slices.SortFunc(entries, func(a, b suggestion) int {
+		if a.Weight != b.Weight {
+			return b.Weight - a.Weight
+		}
+		return strings.Compare(a.Text, b.Text)
+	})
+
+	trie := &suggestionTrie{root: &trieNode{}, entries: entries}
+	for i, entry := range entries {
+		node := trie.root
+		node.add(int32(i))
+		for j := 0; j < len(entry.Text); j++ {
+			next := node.child(entry.Text[j])
+			if next == nil {
+				next = &trieNode{}
+				node.keys = append(node.keys, entry.Text[j])
+				node.children = append(node.children, next)
+			}
+			node = next
+			node.add(int32(i))
+		}
+	}
+
+	return trie
+}
+
+func (node *trieNode) add(entry int32) {
+	if len(node.best) < maxSuggestions {
+		node.best = append(node.best, entry)
+	}
+}
+
+// best entries starting with prefix
+func (trie *suggestionTrie) complete(prefix string, limit int) []suggestion {
+	if trie == nil {
+		return []suggestion{}
+	}
+
+	node := trie.root
+	for i := 0; i < len(prefix) && node != nil; i++ {
+		node = node.child(prefix[i])
+	}
+
+	suggestions := []suggestion{}
+	if node == nil {
+		return suggestions
+	}
+
+	for _, entry := range node.best[:min(limit, len(node.best))] {
+		suggestions = append(suggestions, trie.entries[entry])
+	}
+
+	return suggestions
+}
+
+// builds the trie of unstemmed words the indexer saw, nil when the
+// generation was built before the indexer stored them
+func loadSuggestions(dictionaryDB string) (*suggestionTrie, error) {
+	ddb, err := sql.Open("sqlite", dictionaryDB)
+	if err != nil {
+		return nil, err
+	}
+	defer ddb.Close()
+
+	var tables int
+	err = ddb.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'surfaceForms'").Scan(&tables)
+	if err != nil || tables == 0 {
+		return nil, err
+	}
+
+	rows, err := ddb.Query("SELECT word, documentFrequency FROM surfaceForms")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []suggestion
+	for rows.Next() {
+		entry := suggestion{Source: suggestionTerm}
+		err := rows.Scan(&entry.Text, &entry.Weight)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return newSuggestionTrie(entries), nil
+}
+
+// counts of the queries in the query log that found results, kept per utc
+// day so days leaving the window can be dropped. The trie is rebuilt in the
+// background and swapped in whole.
+type pastQueryStore struct {
+	mu    sync.Mutex                // guards days and dirty
+	days  map[string]map[string]int // day -> query -> count
+	dirty bool
+	trie  atomic.Pointer[suggestionTrie]
+}
+
+// nil while the query log is off
+var pastQueries *pastQueryStore
+
+// reads the recent queries of the query log
+func loadPastQueries(path string) (*pastQueryStore, error) {
+	store := &pastQueryStore{days: make(map[string]map[string]int)}
+
+	err := readQueryLog(path, time.Now().Add(-pastQueryWindow), time.Time{}, func(record queryLogRecord) {
+		if record.Hits > 0 {
+			store.addLocked(record.Query, record.Time)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	store.maintain(time.Now())
+	return store, nil
+}
+
+// the form queries are counted and completed in
+func normalizeQueryText(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+func (store *pastQueryStore) add(text string) {
+	if store == nil {
+		return
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.addLocked(text, time.Now())
+}
+
+func (store *pastQueryStore) addLocked(text string, at time.Time) {
+	day := at.UTC().Format(time.DateOnly)
+	if store.days[day] == nil {
+		store.days[day] = make(map[string]int)
+	}
+	store.days[day][normalizeQueryText(text)]++
+	store.dirty = true
+}
+
+// drops the days that have left the window, then rebuilds the trie if
+// anything changed
+func (store *pastQueryStore) maintain(now time.Time) {
+	store.mu.Lock()
+	oldest := now.Add(-pastQueryWindow).UTC().Format(time.DateOnly)
+	for day := range store.days {
+		if day < oldest {
+			delete(store.days, day)
+			store.dirty = true
+		}
+	}
+
+	if !store.dirty && store.trie.Load() != nil {
+		store.mu.Unlock()
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, day := range store.days {
+		for text, count := range day {
+			counts[text] += count
+		}
+	}
+	store.dirty = false
+	store.mu.Unlock()
+
+	var entries []suggestion
+	for text, count := range counts {
+		if count >= minPastQueryCount && text != "" {
+			entries = append(entries, suggestion{Text: text, Weight: count, Source: suggestionQuery})
+		}
+	}
+	store.trie.Store(newSuggestionTrie(entries))
+}
+
+// maintains the store every interval until stop is closed
+func (store *pastQueryStore) maintainEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			store.maintain(now)
+		}
+	}
+}
+
+// most searched past queries starting with prefix, new queries show up
+// once the store is next maintained
+func (store *pastQueryStore) complete(prefix string, limit int) []suggestion {
+	if store == nil {
+		return []suggestion{}
+	}
+
+	return store.trie.Load().complete(prefix, limit)
+}
+
+// past queries starting with prefix, then completions of its last word
+// with the words before it kept as they were typed
+func suggest(gen *indexGeneration, prefix string, limit int) []suggestion {
+	queryPrefix := normalizeQueryText(prefix)
+	if queryPrefix != "" && strings.TrimRight(prefix, " \t") != prefix {
+		queryPrefix += " "
+	}
+
+	suggestions := pastQueries.complete(queryPrefix, limit)
+	seen := make(map[string]bool)
+	for _, past := range suggestions {
+		seen[past.Text] = true
+	}
+
+	typed, last := "", strings.ToLower(prefix)
+	split := strings.LastIndexAny(prefix, " \t")
+	if split >= 0 {
+		typed, last = prefix[:split+1], strings.ToLower(prefix[split+1:])
+	}
+
+	// a trailing space means the last word is finished
+	if last == "" {
+		return suggestions
+	}
+
+	for _, completion := range gen.suggestions.complete(last, limit) {
+		completion.Text = typed + completion.Text
+		if len(suggestions) >= limit || seen[normalizeQueryText(completion.Text)] {
+			continue
+		}
+		suggestions = append(suggestions, completion)
+	}
+
+	return suggestions
+}
+
+// GET /suggest?prefix= returns the most searched past queries starting with
+// prefix and the most used words completing its last word
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if strings.TrimSpace(prefix) == "" {
+		writeError(w, r, invalidRequest("query parameter prefix is required"))
+		return
+	}
+
+	limit := defaultSuggestions
+	limitParam := r.URL.Query().Get("limit")
+	if limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxSuggestions {
+			writeError(w, r, invalidRequest("limit must be between 1 and %d", maxSuggestions))
+			return
+		}
+	}
+
+	gen, err := acquireGeneration()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer gen.release()
+
+	if gen.suggestions == nil && pastQueries == nil {
+		writeError(w, r, errSuggestionsUnavailable)
+		return
+	}
+
+	writeJSON(w, r, suggestResponse{Prefix: prefix, Suggestions: suggest(gen, prefix, limit)})
+	fmt.Println("served suggestions:", prefix)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//go:embed ui/*.html
+var uiFiles embed.FS
+
+var uiTemplate = template.Must(template.ParseFS(uiFiles, "ui/index.html"))
+var cacheTemplate = template.Must(template.ParseFS(uiFiles, "ui/cache.html"))
+
+// whether the server renders its own search page at /
+var serveUI bool = true
+
+type uiResult struct {
+	DocId   int
+	Rank    int // position in the whole result list, from 1
+	Url     string
+	Title   string
+	Snippet template.HTML
+}
+
+type uiPage struct {
+	Query      string
+	Searched   bool
+	Error      string
+	Suggestion string
+	Results    []uiResult
+	Total      int
+	First      int
+	Last       int
+	PrevPage   int
+	NextPage   int
+	Partial    bool
+}
+
+// renders the search page, running the query server side when q is set so
+// the page works without javascript
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	page := uiPage{Query: r.URL.Query().Get("q")}
+	if page.Query == "" {
+		renderPage(w, r, uiTemplate, http.StatusOK, page)
+		return
+	}
+	page.Searched = true
+
+	status, err := runUISearch(r, &page)
+	if err != nil {
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) {
+			apiErr = errInternal
+		}
+		fmt.Println("request", requestIdFrom(r.Context()), "failed:", r.URL.Path, err)
+
+		page.Error = apiErr.Message
+		renderPage(w, r, uiTemplate, apiErr.Status, page)
+		return
+	}
+
+	renderPage(w, r, uiTemplate, status, page)
+	fmt.Println("served ui query:", page.Query)
+}
+
+func runUISearch(r *http.Request, page *uiPage) (int, error) {
+	pageNumber := 1
+	pageParam := r.URL.Query().Get("page")
+	if pageParam != "" {
+		var err error
+		pageNumber, err = strconv.Atoi(pageParam)
+		if err != nil || pageNumber < 1 {
+			return 0, errInvalidPaging
+		}
+	}
+
+	query, err := parseSearchQuery(r)
+	if err != nil {
+		return 0, err
+	}
+	query.Offset = (pageNumber - 1) * query.Limit
+
+	gen, err := acquireGeneration()
+	if err != nil {
+		return 0, err
+	}
+	defer gen.release()
+
+	ctx, cancel, err := searchContext(r)
+	if err != nil {
+		return 0, err
+	}
+	defer cancel()
+
+	start := time.Now()
+	results, err := search(ctx, gen, query)
+	latency := time.Since(start)
+	logQuery(clientId(r), "/", query, results, latency, err)
+	if err != nil {
+		return 0, err
+	}
+	observeSearch(latency, results)
+
+	for i, result := range results.Results {
+		page.Results = append(page.Results, uiResult{
+			DocId:   result.DocId,
+			Rank:    query.Offset + i + 1,
+			Url:     result.DocUrl,
+			Title:   result.Title,
+			Snippet: highlight(result.Snippet, query.Terms),
+		})
+	}
+
+	page.Total = results.Total
+	// spelling suggestions only get what is left of the time budget
+	if !results.Partial {
+		page.Suggestion = spellingSuggestion(ctx, gen, query.Text)
+	}
+	page.Partial = results.Partial
+	page.First = query.Offset + 1
+	page.Last = query.Offset + len(results.Results)
+	if pageNumber > 1 {
+		page.PrevPage = pageNumber - 1
+	}
+	if page.Last < page.Total {
+		page.NextPage = pageNumber + 1
+	}
+
+	return http.StatusOK, nil
+}
+
+func renderPage(w http.ResponseWriter, r *http.Request, tmpl *template.Template, status int, page any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	err := tmpl.Execute(w, page)
+	if err != nil {
+		fmt.Println("request", requestIdFrom(r.Context()), "failed to render page:", err)
+	}
+}
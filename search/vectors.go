@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+)
+
+// whether the generation kept document term vectors, older indexes dropped
+// them once document lengths were computed
+func hasTermVectors(gen *indexGeneration) (bool, error) {
+	var tables int
+	err := gen.idb.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'docIdToTermVector'").Scan(&tables)
+	return tables > 0, err
+}
+
+// how often each term occurs in a document
+func getTermFrequencies(ctx context.Context, tx sqlQuerier, docId int) (map[string]int, error) {
+	var jsonVector string
+	row := tx.QueryRowContext(ctx, "SELECT vector FROM docIdToTermVector WHERE docId = ?", docId)
+	err := row.Scan(&jsonVector)
+	if err != nil {
+		return nil, err
+	}
+
+	var termToFrequency map[string]int
+	err = json.Unmarshal([]byte(jsonVector), &termToFrequency)
+	if err != nil {
+		return nil, err
+	}
+
+	return termToFrequency, nil
+}
+
+// tf-idf weights of a document's terms scaled to unit length, so the dot
+// product of two vectors is their cosine similarity
+func getTermVector(ctx context.Context, tx sqlQuerier, docId int, dictionary map[string]float64) (map[string]float64, error) {
+	termToFrequency, err := getTermFrequencies(ctx, tx, docId)
+	if err != nil {
+		return nil, err
+	}
+
+	return unitTermVector(termToFrequency, dictionary), nil
+}
+
+func unitTermVector(termToFrequency map[string]int, dictionary map[string]float64) map[string]float64 {
+	vector := make(map[string]float64, len(termToFrequency))
+	var length float64
+	for term, frequency := range termToFrequency {
+		weight := logTermFrequency(frequency) * dictionary[term]
+		if weight > 0 {
+			vector[term] = weight
+			length += weight * weight
+		}
+	}
+
+	length = math.Sqrt(length)
+	for term := range vector {
+		vector[term] /= length
+	}
+
+	return vector
+}
+
+// cosine similarity of two unit length vectors
+func vectorSimilarity(a map[string]float64, b map[string]float64) float64 {
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+
+	var dot float64
+	for term, weight := range a {
+		dot += weight * b[term]
+	}
+
+	return dot
+}